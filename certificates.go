@@ -0,0 +1,188 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bitbucket.org/cjslep/dailyLogger"
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCertificateReloadInterval = 60 * time.Second
+)
+
+// certificateReloader holds the certificate pair served over TLS and periodically
+// checks the certificate and key files for changes. New handshakes pick up a rotated
+// pair while established connections keep using the one they negotiated.
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	interval    time.Duration
+	logger      *dailyLogger.DailyLogger
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	stop        chan bool
+	done        chan bool
+}
+
+// newTLSConfig builds the TLS configuration described by the options. It returns a nil
+// configuration if the options do not ask for TLS, and a nil reloader if the
+// certificates are not loaded from disk.
+func newTLSConfig(options *ServerOptions, logger *dailyLogger.DailyLogger) (*tls.Config, *certificateReloader, error) {
+	if options.CertificateFile == "" && options.KeyFile == "" {
+		if options.TLSConfig == nil {
+			return nil, nil, nil
+		}
+		if len(options.TLSConfig.Certificates) == 0 && options.TLSConfig.GetCertificate == nil && options.TLSConfig.GetConfigForClient == nil {
+			return nil, nil, errors.New("buv: TLSConfig has no certificates and no CertificateFile or KeyFile specified")
+		}
+		return options.TLSConfig.Clone(), nil, nil
+	}
+	if options.CertificateFile == "" || options.KeyFile == "" {
+		return nil, nil, errors.New("buv: both CertificateFile and KeyFile must be specified to serve TLS")
+	}
+	interval := time.Duration(options.CertificateReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultCertificateReloadInterval
+	}
+	reloader, err := newCertificateReloader(options.CertificateFile, options.KeyFile, interval, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{}
+	if options.TLSConfig != nil {
+		config = options.TLSConfig.Clone()
+	}
+	config.Certificates = nil
+	config.GetCertificate = reloader.getCertificate
+	return config, reloader, nil
+}
+
+func newCertificateReloader(certFile, keyFile string, interval time.Duration, logger *dailyLogger.DailyLogger) (*certificateReloader, error) {
+	c := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		logger:   logger,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	logger.Println("Loaded TLS certificate pair: " + certFile + ", " + keyFile)
+	return c, nil
+}
+
+func (c *certificateReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.certificate, nil
+}
+
+// Start begins watching the certificate pair for changes.
+func (c *certificateReloader) Start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan bool)
+	c.done = make(chan bool)
+	go c.watch(c.stop, c.done)
+}
+
+// Stop ends watching the certificate pair for changes. The last loaded pair continues
+// to be served.
+func (c *certificateReloader) Stop() {
+	c.mutex.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.mutex.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (c *certificateReloader) watch(stop <-chan bool, done chan<- bool) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	defer close(done)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed, err := c.changed()
+			if err != nil {
+				c.logger.Println("TLS certificate check error: " + err.Error())
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if err := c.load(); err != nil {
+				c.logger.Println("TLS certificate reload error, continuing with previous pair: " + err.Error())
+			} else {
+				c.logger.Println("Rotated TLS certificate pair: " + c.certFile + ", " + c.keyFile)
+			}
+		}
+	}
+}
+
+func (c *certificateReloader) changed() (bool, error) {
+	certStat, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyStat, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return !certStat.ModTime().Equal(c.certModTime) || !keyStat.ModTime().Equal(c.keyModTime), nil
+}
+
+func (c *certificateReloader) load() error {
+	certStat, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.certificate = &certificate
+	c.certModTime = certStat.ModTime()
+	c.keyModTime = keyStat.ModTime()
+	return nil
+}
@@ -0,0 +1,129 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"strings"
+)
+
+// RouteConfig describes a route in the Routes of the ServerOptions, so routes may be declared in
+// the config file. Its handler and redirectors are referred to by the names they were given with
+// RegisterHandler and RegisterRedirector. The fields mirror the parameters of AddHandleFunc.
+type RouteConfig struct {
+	// Path is the URI/URA to handle.
+	Path string
+
+	// Name is the unique name of the route, used by GetUrl and by the Parent of other routes.
+	Name string
+
+	// Methods are the HTTP methods to handle.
+	Methods []string
+
+	// Schemes are the request schemes to handle.
+	Schemes []string
+
+	// Queries are the queries that must be present to handle. A value of "" matches any value.
+	Queries map[string]string
+
+	// Parent is the optional name of the route this route is a subroute of, as described by
+	// RouteBuilder's Parent. It must be declared before this route, or registered in code.
+	Parent string
+
+	// Redirectors are the names of the redirectors that guard the handler, in order.
+	Redirectors []string
+
+	// Handler is the name of the handler function.
+	Handler string
+}
+
+// RegisterHandler names a handler function so routes in the config file may refer to it.
+func (b *Server) RegisterHandler(name string, handleFunc HandlerFunction) {
+	b.logger.Println("RegisterHandler name=" + name)
+	b.handlers[name] = handleFunc
+}
+
+// RegisterRedirector names a redirector so routes in the config file may refer to it.
+func (b *Server) RegisterRedirector(name string, redirector Redirector) {
+	b.logger.Println("RegisterRedirector name=" + name)
+	b.redirectors[name] = redirector
+}
+
+// RegisterConfigRoutes registers the Routes of the ServerOptions. It returns an error naming
+// every handler, redirector and parent route that was not registered, every duplicate name and
+// every malformed route, in which case no routes are registered. It is called by Start, and does
+// nothing once the routes have been registered.
+func (b *Server) RegisterConfigRoutes() error {
+	if b.routesLoaded {
+		return nil
+	}
+	configs := b.getOptions().Routes
+	var missing []string
+	declared := make(map[string]bool)
+	for _, config := range configs {
+		if config.Parent != "" && !declared[config.Parent] && b.router.Get(config.Parent) == nil {
+			missing = append(missing, "route "+config.Name+" parent "+config.Parent)
+		}
+		if config.Name != "" && declared[config.Name] {
+			missing = append(missing, "route "+config.Name+" declared more than once")
+		}
+		declared[config.Name] = true
+		if _, ok := b.handlers[config.Handler]; !ok {
+			missing = append(missing, "route "+config.Name+" handler "+config.Handler)
+		}
+		for _, name := range config.Redirectors {
+			if _, ok := b.redirectors[name]; !ok {
+				missing = append(missing, "route "+config.Name+" redirector "+name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		err := errors.New("buv: config routes refer to unregistered names: " + strings.Join(missing, ", "))
+		b.logger.Println(err.Error())
+		return err
+	}
+	routes := make([]*RouteBuilder, len(configs))
+	var invalid []string
+	for i, config := range configs {
+		route := b.Route(config.Path).Name(config.Name).Schemes(config.Schemes...).Methods(config.Methods...).Parent(config.Parent)
+		for key, value := range config.Queries {
+			route.Queries(key, value)
+		}
+		for _, name := range config.Redirectors {
+			route.Guard(b.redirectors[name])
+		}
+		if err := route.validate(declared); err != nil {
+			invalid = append(invalid, err.Error())
+		}
+		routes[i] = route
+	}
+	if len(invalid) > 0 {
+		err := errors.New("buv: config routes are invalid: " + strings.Join(invalid, ", "))
+		b.logger.Println(err.Error())
+		return err
+	}
+	for i, route := range routes {
+		if err := route.Handle(b.handlers[configs[i].Handler]); err != nil {
+			b.logger.Println("RegisterConfigRoutes: " + err.Error())
+			return err
+		}
+	}
+	b.routesLoaded = true
+	return nil
+}
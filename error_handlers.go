@@ -0,0 +1,107 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// ErrorHandlerFunction is an alternative to HandlerFunction that returns an error instead of
+// answering the request itself when it fails. Returning an HTTPError chooses the status code and
+// message shown to the client; any other error is answered with 500 Internal Server Error.
+type ErrorHandlerFunction func(data *HandlerData) error
+
+// ErrorRenderer answers a request whose ErrorHandlerFunction returned an error.
+type ErrorRenderer func(data *HandlerData, err *HTTPError)
+
+// ErrorPage is the data given to the ServerOptions' ErrorTemplate.
+type ErrorPage struct {
+	// Status is the HTTP status code of the response.
+	Status int
+
+	// StatusText is the text of the status code, such as "Not Found".
+	StatusText string
+
+	// Message is the HTTPError's public message.
+	Message string
+
+	// Data is the request's HandlerData.
+	Data *HandlerData
+}
+
+// ErrorHandler adapts the error returning handler function into a HandlerFunction, so it may be
+// given to AddHandleFunc or RegisterHandler. Errors it returns are logged with the request and
+// rendered by the Server's ErrorRenderer.
+func (b *Server) ErrorHandler(handleFunc ErrorHandlerFunction) HandlerFunction {
+	return func(data *HandlerData) {
+		err := handleFunc(data)
+		if err == nil {
+			return
+		}
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) {
+			httpErr = &HTTPError{Err: err}
+		}
+		b.logger.Println("Handler error: " + err.Error() + ": " + data.String())
+		if data.HeadersSent() || data.tooLarge {
+			b.logger.Println("Handler error: response already sent, not rendering status " + strconv.Itoa(httpErr.status()) + ": " + data.String())
+			return
+		}
+		renderer := b.errorRenderer
+		if renderer == nil {
+			renderer = b.renderError
+		}
+		renderer(data, httpErr)
+	}
+}
+
+// SetErrorRenderer replaces the default ErrorRenderer, which answers with a JSONError for
+// requests that accept or send JSON, and otherwise renders the ServerOptions' ErrorTemplate.
+func (b *Server) SetErrorRenderer(renderer ErrorRenderer) {
+	b.logger.Println("SetErrorRenderer")
+	b.errorRenderer = renderer
+}
+
+// renderError is the default ErrorRenderer.
+func (b *Server) renderError(data *HandlerData, err *HTTPError) {
+	status := err.status()
+	if wantsJSON(data.r) {
+		data.WriteJSON(status, &JSONError{Error: err.message()})
+		return
+	}
+	if tmpl := b.getOptions().ErrorTemplate; tmpl != "" {
+		data.SetHeader("Content-Type", "text/html; charset=utf-8")
+		data.RenderTemplateStatus(status, tmpl, &ErrorPage{status, http.StatusText(status), err.message(), data})
+		return
+	}
+	http.Error(data.w, err.message(), status)
+}
+
+// wantsJSON returns whether the request is from an API client: one that accepts JSON but not
+// every media type, or that sent a JSON body.
+func wantsJSON(r *http.Request) bool {
+	if accept := r.Header.Get("Accept"); accept != "" && acceptsMediaType(accept, []string{"application/json"}) {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
@@ -0,0 +1,177 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+var (
+	// ErrAddressInUse is the kind of StartError returned when the address is already bound.
+	ErrAddressInUse = errors.New("buv: address already in use")
+
+	// ErrPermissionDenied is the kind of StartError returned when the process may not bind
+	// the address, such as a privileged port.
+	ErrPermissionDenied = errors.New("buv: permission denied")
+
+	// ErrTemplateWatcher is the kind of StartError returned when the template watcher could
+	// not be started.
+	ErrTemplateWatcher = errors.New("buv: template watcher failure")
+
+	// ErrConfigRoutes is the kind of StartError returned when the Routes of the ServerOptions
+	// could not be registered.
+	ErrConfigRoutes = errors.New("buv: config routes failure")
+
+	// ErrServerStarted is returned when starting a Server that is already serving.
+	ErrServerStarted = errors.New("buv: server already started")
+
+	// ErrServerNotStarted is returned when waiting on or shutting down a Server that was
+	// never started.
+	ErrServerNotStarted = errors.New("buv: server not started")
+
+	// ErrRequestTooLarge is returned when reading a request body that exceeds its route's size
+	// limit, in which case the request has been answered with 413 Request Entity Too Large.
+	ErrRequestTooLarge = errors.New("buv: request body too large")
+
+	// ErrMalformedForm is wrapped by the error returned when reading a request's form fails
+	// for a reason other than its size, in which case the request has been answered with 400
+	// Bad Request.
+	ErrMalformedForm = errors.New("buv: malformed form")
+
+	// ErrBodyWhileMatching is returned when a matcher given to RouteBuilder's Match attempts to
+	// read the request body, which is left for the handler.
+	ErrBodyWhileMatching = errors.New("buv: request body cannot be read while matching a route")
+
+	// ErrNoUpload is returned when no file was uploaded with a form field.
+	ErrNoUpload = errors.New("buv: no file uploaded")
+
+	// ErrUploadTooLarge is returned when an uploaded file exceeds its route's size limit.
+	ErrUploadTooLarge = errors.New("buv: uploaded file too large")
+
+	// ErrUploadType is returned when an uploaded file's content is not of a type allowed by its
+	// route.
+	ErrUploadType = errors.New("buv: uploaded file type not allowed")
+)
+
+// StartError is returned by Start when the Server could not begin serving. The Server is
+// left stopped and may be started again. Use errors.Is with ErrAddressInUse,
+// ErrPermissionDenied, ErrTemplateWatcher or ErrConfigRoutes to determine the kind of failure.
+type StartError struct {
+	// Address is the address the Server attempted to serve on.
+	Address string
+
+	// Kind is one of the Err variables of this package, or nil if the failure did not fall
+	// into a known category.
+	Kind error
+
+	// Err is the underlying error.
+	Err error
+}
+
+func newStartError(address string, err error) *StartError {
+	var kind error
+	if errors.Is(err, syscall.EADDRINUSE) {
+		kind = ErrAddressInUse
+	} else if errors.Is(err, os.ErrPermission) {
+		kind = ErrPermissionDenied
+	}
+	return &StartError{address, kind, err}
+}
+
+func (e *StartError) Error() string {
+	if e.Kind != nil {
+		return e.Kind.Error() + " starting on " + e.Address + ": " + e.Err.Error()
+	}
+	return "buv: error starting on " + e.Address + ": " + e.Err.Error()
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StartError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// ShutdownError is returned by Run when the in-flight requests could not be drained before
+// the ShutdownTimeout and were forcibly closed.
+type ShutdownError struct {
+	// ForceClosed is the number of requests that were in flight when forcibly closed.
+	ForceClosed int
+
+	// Err is the error the drain ended with.
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	return "buv: forcibly closed " + strconv.Itoa(e.ForceClosed) + " in-flight requests: " + e.Err.Error()
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPError is returned by an ErrorHandlerFunction to answer the request with the status code
+// and a message safe to show the client. The underlying error is logged but not shown.
+type HTTPError struct {
+	// Status is the HTTP status code of the response. A value of 0 uses 500 Internal Server
+	// Error.
+	Status int
+
+	// Message is shown to the client. A value of "" uses the text of the status code.
+	Message string
+
+	// Err is the underlying error, which may be nil.
+	Err error
+}
+
+// NewHTTPError creates an HTTPError with the status code, public message and underlying error.
+func NewHTTPError(status int, message string, err error) *HTTPError {
+	return &HTTPError{status, message, err}
+}
+
+func (e *HTTPError) Error() string {
+	s := "buv: " + strconv.Itoa(e.status()) + " " + e.message()
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+func (e *HTTPError) status() int {
+	if e.Status == 0 {
+		return http.StatusInternalServerError
+	}
+	return e.Status
+}
+
+func (e *HTTPError) message() string {
+	if e.Message == "" {
+		return http.StatusText(e.status())
+	}
+	return e.Message
+}
@@ -0,0 +1,407 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	FORM_TAG     = "form"
+	VALIDATE_TAG = "validate"
+	LAYOUT_TAG   = "layout"
+)
+
+// formTimeLayouts are tried in order when parsing a time.Time field without a layout tag. They
+// cover the values sent by HTML date, datetime-local and time inputs.
+var formTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"15:04:05",
+	"15:04",
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// FormErrors maps the form names of fields to what is wrong with their values. It is returned
+// by BindForm when the form's values cannot be converted or fail validation, and may be given
+// to a template to show each message beside its field:
+//
+//	{{with index .Errors "email"}}<span class="error">{{.}}</span>{{end}}
+type FormErrors map[string]string
+
+// Error lists every field's message, ordered by field name.
+func (f FormErrors) Error() string {
+	fields := make([]string, 0, len(f))
+	for field := range f {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	messages := make([]string, len(fields))
+	for i, field := range fields {
+		messages[i] = field + ": " + f[field]
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Has returns whether the field has an error.
+func (f FormErrors) Has(field string) bool {
+	_, ok := f[field]
+	return ok
+}
+
+// BindForm decodes the request's post and query values into the struct pointed to by dst. Post
+// values take precedence over query values of the same name.
+//
+// Each exported field is filled from the value named by its form tag, or by the field's name if
+// it has none; a form tag of "-" skips the field. Fields may be strings, bools, ints, uints,
+// floats, time.Times or slices of them, and anonymous struct fields are decoded in place. Times
+// are parsed with the layout given by the field's layout tag, or else as RFC 3339, or as sent by
+// HTML date, datetime-local and time inputs.
+//
+// The field's validate tag lists comma separated rules:
+//
+//	required     the value is present and not empty
+//	min=N        strings have at least N characters, slices N values, and numbers are at least N
+//	max=N        strings have at most N characters, slices N values, and numbers are at most N
+//	email        the value is an email address
+//	regex=EXPR   the value matches the regular expression, which must be the last rule
+//
+// Rules other than required are only checked for values that are present. For example:
+//
+//	type signup struct {
+//		Email    string    `form:"email" validate:"required,email"`
+//		Name     string    `form:"name" validate:"required,max=64"`
+//		Age      int       `form:"age" validate:"min=13"`
+//		Born     time.Time `form:"born" layout:"2006-01-02"`
+//		Topics   []string  `form:"topic" validate:"max=5"`
+//		Username string    `form:"user" validate:"required,regex=^[a-z0-9_]+$"`
+//	}
+//
+// It returns FormErrors if any value cannot be converted or fails validation, in which case the
+// other fields are still filled. It returns ErrRequestTooLarge if the request body exceeds its
+// route's size limit, and an error if dst is not a pointer to a struct or its tags are invalid.
+func (h *HandlerData) BindForm(dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("buv: BindForm requires a pointer to a struct")
+	}
+	if err := h.parseForm(true); err != nil {
+		return err
+	}
+	formErrors := make(FormErrors)
+	if err := bindStruct(v.Elem(), h.r.Form, formErrors); err != nil {
+		h.server.Println("BindForm: " + err.Error() + ": " + h.String())
+		return err
+	}
+	if len(formErrors) > 0 {
+		return formErrors
+	}
+	return nil
+}
+
+// FlashFormErrors adds the form errors as flash messages under the flash key, so they can be
+// retrieved with GetFlashFormErrors after redirecting back to the form.
+func (h *HandlerData) FlashFormErrors(sessionName, flashKey string, formErrors FormErrors) {
+	for field, message := range formErrors {
+		h.SetFlashMessage(sessionName, field+"="+message, flashKey)
+	}
+}
+
+// GetFlashFormErrors returns the form errors added by FlashFormErrors under the flash key, or
+// nil if there are none.
+func (h *HandlerData) GetFlashFormErrors(sessionName, flashKey string) FormErrors {
+	messages := h.GetStringFlashMessages(sessionName, flashKey)
+	if len(messages) == 0 {
+		return nil
+	}
+	formErrors := make(FormErrors, len(messages))
+	for _, message := range messages {
+		if i := strings.Index(message, "="); i >= 0 {
+			formErrors[message[:i]] = message[i+1:]
+		}
+	}
+	return formErrors
+}
+
+// bindStruct fills the fields of the struct from the values, recording conversion and
+// validation failures in the form errors. It returns an error if a tag is invalid.
+func bindStruct(v reflect.Value, values map[string][]string, formErrors FormErrors) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get(FORM_TAG)
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && name == "" {
+			if err := bindStruct(v.Field(i), values, formErrors); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		rules, err := parseRules(v.Field(i), field)
+		if err != nil {
+			return err
+		}
+		fieldValues := values[name]
+		if err := setField(v.Field(i), field, fieldValues); err != nil {
+			var message *formMessage
+			if errors.As(err, &message) {
+				formErrors[name] = message.text
+				continue
+			}
+			return err
+		}
+		if message := validateField(v.Field(i), rules, fieldValues); message != "" {
+			formErrors[name] = message
+		}
+	}
+	return nil
+}
+
+// formMessage is a failure to convert a form value, reported to the user rather than the
+// programmer.
+type formMessage struct {
+	text string
+}
+
+func (f *formMessage) Error() string {
+	return f.text
+}
+
+// setField sets the field from its form values, leaving it untouched if there are none.
+func setField(v reflect.Value, field reflect.StructField, values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	if v.Kind() == reflect.Slice && v.Type() != reflect.TypeOf([]byte(nil)) {
+		slice := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setValue(slice.Index(i), field, value); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+	return setValue(v, field, values[0])
+}
+
+// setValue converts the form value to the type of v and sets it. An empty value leaves v at its
+// zero value.
+func setValue(v reflect.Value, field reflect.StructField, value string) error {
+	if value == "" && v.Kind() != reflect.String {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Type() == timeType {
+		t, ok := parseFormTime(field.Tag.Get(LAYOUT_TAG), value)
+		if !ok {
+			return &formMessage{"must be a valid time"}
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		switch strings.ToLower(value) {
+		case "on", "yes":
+			v.SetBool(true)
+		case "off", "no":
+			v.SetBool(false)
+		default:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return &formMessage{"must be true or false"}
+			}
+			v.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return &formMessage{"must be a whole number"}
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return &formMessage{"must be a positive whole number"}
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return &formMessage{"must be a number"}
+		}
+		v.SetFloat(f)
+	default:
+		return errors.New("buv: BindForm cannot decode field " + field.Name + " of type " + v.Type().String())
+	}
+	return nil
+}
+
+// parseFormTime parses the value with the layout, or with the formTimeLayouts if it is "".
+func parseFormTime(layout, value string) (time.Time, bool) {
+	layouts := formTimeLayouts
+	if layout != "" {
+		layouts = []string{layout}
+	}
+	for _, l := range layouts {
+		if t, err := time.Parse(l, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// validateRule is a rule of a field's validate tag, checked when the tag is parsed.
+type validateRule struct {
+	rule string
+	name string
+	arg  string
+	re   *regexp.Regexp
+}
+
+// parseRules parses and checks the field's validate rules, returning an error if a rule is
+// unknown, its argument is malformed or it does not apply to the field's type. The rules are
+// checked whether or not the form carries a value for the field.
+func parseRules(v reflect.Value, field reflect.StructField) ([]validateRule, error) {
+	var rules []validateRule
+	tag := field.Tag.Get(VALIDATE_TAG)
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regex=") {
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+		r := validateRule{rule: rule, name: rule}
+		if i := strings.Index(rule, "="); i >= 0 {
+			r.name, r.arg = rule[:i], rule[i+1:]
+		}
+		var err error
+		switch r.name {
+		case "required", "email":
+		case "min", "max":
+			_, err = validateBound(v, r.name, r.arg)
+		case "regex":
+			r.re, err = regexp.Compile(r.arg)
+		default:
+			err = errors.New("unknown rule")
+		}
+		if err != nil {
+			return nil, errors.New("buv: BindForm field " + field.Name + " rule " + rule + ": " + err.Error())
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// validateField checks the field's parsed validate rules, returning a message describing the
+// first that failed or "" if all passed. Only the required rule applies to an absent value.
+func validateField(v reflect.Value, rules []validateRule, values []string) string {
+	present := len(values) > 0 && values[0] != ""
+	for _, r := range rules {
+		if r.name == "required" {
+			if !present {
+				return "is required"
+			}
+			continue
+		}
+		if !present {
+			continue
+		}
+		var message string
+		switch r.name {
+		case "min", "max":
+			message, _ = validateBound(v, r.name, r.arg)
+		case "email":
+			if addr, err := mail.ParseAddress(values[0]); err != nil || addr.Address != values[0] {
+				message = "must be an email address"
+			}
+		case "regex":
+			if !r.re.MatchString(values[0]) {
+				message = "is not in the expected format"
+			}
+		}
+		if message != "" {
+			return message
+		}
+	}
+	return ""
+}
+
+// validateBound checks a min or max rule against the length of a string or slice, or against
+// the value of a number.
+func validateBound(v reflect.Value, name, arg string) (string, error) {
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return "", err
+	}
+	var n float64
+	var unit string
+	switch v.Kind() {
+	case reflect.String:
+		n, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice:
+		n, unit = float64(v.Len()), " values"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	default:
+		return "", errors.New("not supported for type " + v.Type().String())
+	}
+	if name == "min" && n < bound {
+		if unit != "" {
+			return "must have at least " + arg + unit, nil
+		}
+		return "must be at least " + arg, nil
+	}
+	if name == "max" && n > bound {
+		if unit != "" {
+			return "must have at most " + arg + unit, nil
+		}
+		return "must be at most " + arg, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,130 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Group shares a path prefix, host, redirectors and middleware across all of the routes
+// registered under it:
+//
+//	admin := s.Group("/admin", adminOnly)
+//	err := admin.Route("/users").Name("adminUsers").Methods("GET").Handle(fn)
+//
+// Groups may be nested, in which case prefixes are joined and the outer group's redirectors
+// and middleware act before the inner group's. Route names remain global to the Server, so
+// GetUrl builds the full URL of a route registered under a Group from its name alone.
+type Group struct {
+	server      *Server
+	parent      *Group
+	prefix      string
+	host        string
+	redirectors []Redirector
+	middleware  []Middleware
+	router      *mux.Router
+	templates   *hostTemplates
+}
+
+// Group creates a Group whose routes share the path prefix and are guarded by the redirectors.
+func (b *Server) Group(prefix string, redirectors ...Redirector) *Group {
+	return &Group{server: b, prefix: prefix, redirectors: redirectors}
+}
+
+// Group creates a Group nested within this one, whose routes share both groups' path prefixes
+// and are guarded by both groups' redirectors.
+func (g *Group) Group(prefix string, redirectors ...Redirector) *Group {
+	return &Group{server: g.server, parent: g, prefix: prefix, redirectors: redirectors}
+}
+
+// Host restricts the Group's routes to requests for the host, which may contain variables
+// such as "{subdomain}.example.com". It must be called before any routes are registered.
+func (g *Group) Host(host string) *Group {
+	if g.router != nil {
+		g.server.logger.Println("Group.Host: routes already registered under " + g.prefix + ", ignoring host " + host)
+		return g
+	}
+	g.host = host
+	return g
+}
+
+// Use adds middleware wrapping every handler registered under the Group, including those
+// registered before Use is called.
+func (g *Group) Use(middleware ...Middleware) *Group {
+	g.middleware = append(g.middleware, middleware...)
+	return g
+}
+
+// Route begins describing a handler for the path within the Group's prefix.
+func (g *Group) Route(path string) *RouteBuilder {
+	return &RouteBuilder{server: g.server, group: g, path: path}
+}
+
+// muxRouter returns the subrouter matching the Group's prefix and host, creating it the first
+// time a route is registered.
+func (g *Group) muxRouter() *mux.Router {
+	if g.router != nil {
+		return g.router
+	}
+	parent := g.server.router
+	if g.parent != nil {
+		parent = g.parent.muxRouter()
+	}
+	route := parent.NewRoute()
+	if g.prefix != "" {
+		route.PathPrefix(g.prefix)
+	}
+	if g.host != "" {
+		route.Host(g.host)
+	}
+	g.router = route.Subrouter()
+	g.server.logger.Println("Group prefix=" + g.prefix + ", host=" + g.host)
+	return g.router
+}
+
+// allRedirectors returns the redirectors of the Group and its parents, outermost first.
+func (g *Group) allRedirectors() []Redirector {
+	if g.parent == nil {
+		return g.redirectors
+	}
+	return append(append([]Redirector{}, g.parent.allRedirectors()...), g.redirectors...)
+}
+
+// wrap applies the middleware of the Group and its parents to the handler, outermost first.
+// The middleware is looked up on each request so that middleware added later still applies.
+func (g *Group) wrap(handleFunc HandlerFunction) HandlerFunction {
+	return func(data *HandlerData) {
+		fn := handleFunc
+		for group := g; group != nil; group = group.parent {
+			fn = chain(fn, group.middleware)
+		}
+		fn(data)
+	}
+}
+
+// templateWatcher returns the templates of the innermost Group with its own, or nil if the
+// Group's routes use the Server's templates.
+func (g *Group) templateWatcher() *hostTemplates {
+	for group := g; group != nil; group = group.parent {
+		if group.templates != nil {
+			return group.templates
+		}
+	}
+	return nil
+}
@@ -19,8 +19,14 @@ package buv
 */
 
 import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -32,26 +38,66 @@ const (
 	HTTP_METHOD_DELETE  = "DELETE"
 	HTTP_METHOD_HEAD    = "HEAD"
 	HTTP_METHOD_OPTIONS = "OPTIONS"
+	HTTP_METHOD_PATCH   = "PATCH"
 
 	HTTP_SCHEME      = "http"
 	HTTPS_SCHEME     = "https"
 	LOCALHOST_SCHEME = ""
 )
 
+var allHTTPMethods = []string{
+	HTTP_METHOD_GET,
+	HTTP_METHOD_HEAD,
+	HTTP_METHOD_POST,
+	HTTP_METHOD_PUT,
+	HTTP_METHOD_PATCH,
+	HTTP_METHOD_DELETE,
+	HTTP_METHOD_CONNECT,
+	HTTP_METHOD_OPTIONS,
+	HTTP_METHOD_TRACE,
+}
+
 type HandlerData struct {
-	w      http.ResponseWriter
-	r      *http.Request
-	server *Server
+	w          http.ResponseWriter
+	r          *http.Request
+	server     *Server
+	templates  *hostTemplates
+	sw         *statusWriter
+	uploads    *uploadSet
+	formParsed bool
+	formErr    error
+	matching   bool
+	tooLarge   bool
 }
 
 // HandlerFunction is the function clients must use when handling requests. It provides access to the specific
 // request's HandlerData, through which handler functions can operate.
 type HandlerFunction func(data *HandlerData)
 
+// Middleware wraps a HandlerFunction, returning a HandlerFunction that may run code both
+// before and after calling the wrapped one, such as timing, recovery or setting response
+// headers. Middleware is registered on the Server, on a Group, or on a single route, and
+// wraps a request's handler in that order from the outside in:
+//
+//	Server middleware -> outer Group middleware -> inner Group middleware -> route middleware
+//	    -> Group redirectors -> route redirectors -> handler
+//
+// Middleware therefore runs even for requests that a redirector redirects. Within each
+// registration, the first middleware given is the outermost.
+type Middleware func(next HandlerFunction) HandlerFunction
+
 // Redirector is a function clients can use to cause a request to be redirected. Upon successful redirection,
 // true must be returned to prevent the default handler from being called.
 type Redirector func(data *HandlerData) bool
 
+// TemplateHandler returns a HandlerFunction that renders the registered template, passing it the
+// request's HandlerData. It is useful for rendering the not found and method not allowed pages.
+func TemplateHandler(templateName string) HandlerFunction {
+	return func(data *HandlerData) {
+		data.RenderTemplate(templateName, data)
+	}
+}
+
 func (h *HandlerData) SetSessionValue(sessionName, key string, value interface{}) {
 	h.server.SetSessionValue(h.w, h.r, sessionName, key, value)
 }
@@ -128,6 +174,10 @@ func (h *HandlerData) IsOptionsMethod() bool {
 	return h.r.Method == HTTP_METHOD_OPTIONS
 }
 
+func (h *HandlerData) IsPatchMethod() bool {
+	return h.r.Method == HTTP_METHOD_PATCH
+}
+
 func (h *HandlerData) Method() string {
 	return h.r.Method
 }
@@ -137,13 +187,67 @@ func (h *HandlerData) Redirect(newURI string, code int) {
 }
 
 func (h *HandlerData) RenderTemplate(templateName string, templateData interface{}) {
-	h.server.RenderTemplate(h.w, templateName, templateData)
+	h.server.executeTemplate(h.templates, h.w, templateName, templateData)
 }
 
 func (h *HandlerData) WriteResponse(response string) {
 	h.w.Write([]byte(response))
 }
 
+// WriteResponseStatus writes the response body with the HTTP status code.
+func (h *HandlerData) WriteResponseStatus(code int, response string) {
+	h.SetStatus(code)
+	h.WriteResponse(response)
+}
+
+// RenderTemplateStatus renders the registered template with the HTTP status code.
+func (h *HandlerData) RenderTemplateStatus(code int, templateName string, templateData interface{}) {
+	h.SetStatus(code)
+	h.RenderTemplate(templateName, templateData)
+}
+
+// SetStatus sets the HTTP status code of the response, which is 200 OK unless set. It is sent
+// along with the headers when the body is first written, or when the handler returns. Setting
+// it after the headers are sent has no effect and is logged.
+func (h *HandlerData) SetStatus(code int) {
+	if h.HeadersSent() {
+		h.server.Println("SetStatus: headers already sent, ignoring status " + strconv.Itoa(code) + ": " + h.String())
+		return
+	}
+	h.sw.status = code
+}
+
+// Status returns the HTTP status code of the response.
+func (h *HandlerData) Status() int {
+	return h.sw.status
+}
+
+// SetHeader sets the response header to the value, replacing any existing values. Setting it
+// after the headers are sent has no effect and is logged.
+func (h *HandlerData) SetHeader(key, value string) {
+	if h.HeadersSent() {
+		h.server.Println("SetHeader: headers already sent, ignoring " + key + ": " + h.String())
+		return
+	}
+	h.w.Header().Set(key, value)
+}
+
+// AddHeader adds the value to the response header. Adding it after the headers are sent has no
+// effect and is logged.
+func (h *HandlerData) AddHeader(key, value string) {
+	if h.HeadersSent() {
+		h.server.Println("AddHeader: headers already sent, ignoring " + key + ": " + h.String())
+		return
+	}
+	h.w.Header().Add(key, value)
+}
+
+// HeadersSent returns whether the status code and headers of the response have been sent, after
+// which they can no longer be changed.
+func (h *HandlerData) HeadersSent() bool {
+	return h.sw.wroteHeader
+}
+
 func (h *HandlerData) Println(logString string) {
 	h.server.Println(logString)
 }
@@ -156,19 +260,107 @@ func (h *HandlerData) Referrer() string {
 	return h.r.Referer()
 }
 
+// PostFormValue returns the first value for the key in the request body, or "" if there is none.
+// A body that is too large or cannot be parsed yields only the values read before the error; use
+// ParsePostFormValue to learn of the error.
 func (h *HandlerData) PostFormValue(key string) string {
-	return h.r.PostFormValue(key)
+	h.parseForm(false)
+	return h.r.PostForm.Get(key)
 }
 
+// PostForm returns the values in the request body. A body that is too large or cannot be parsed
+// yields only the values read before the error; use ParsePostForm to learn of the error.
 func (h *HandlerData) PostForm() url.Values {
-	h.r.ParseForm()
+	h.parseForm(false)
 	return h.r.PostForm
 }
 
+// ParsePostFormValue is like PostFormValue, but returns ErrRequestTooLarge if the body exceeds
+// the route's size limit, or an error wrapping ErrMalformedForm if it cannot be parsed, in which
+// case the request has been answered and the handler should return without writing a response.
+// A value read before the error is still returned.
+func (h *HandlerData) ParsePostFormValue(key string) (string, error) {
+	err := h.parseForm(true)
+	return h.r.PostForm.Get(key), err
+}
+
+// ParsePostForm is like PostForm, but returns ErrRequestTooLarge if the body exceeds the
+// route's size limit, or an error wrapping ErrMalformedForm if it cannot be parsed, in which
+// case the request has been answered and the handler should return without writing a response.
+// The values read before the error are still returned.
+func (h *HandlerData) ParsePostForm() (url.Values, error) {
+	err := h.parseForm(true)
+	return h.r.PostForm, err
+}
+
 func (h *HandlerData) Query() url.Values {
 	return h.r.URL.Query()
 }
 
+// PathVar returns the value of the path variable, such as "id" for a route registered with the
+// path "/users/{id}", or "" if the route has no such variable.
+func (h *HandlerData) PathVar(name string) string {
+	return mux.Vars(h.r)[name]
+}
+
+// PathVars returns all of the path variables of the request's route, keyed by name.
+func (h *HandlerData) PathVars() map[string]string {
+	vars := make(map[string]string)
+	for key, value := range mux.Vars(h.r) {
+		vars[key] = value
+	}
+	return vars
+}
+
+// PathInt returns the path variable converted to an int, or an error if it is missing or not
+// an integer.
+func (h *HandlerData) PathInt(name string) (int, error) {
+	value, ok := mux.Vars(h.r)[name]
+	if !ok {
+		return 0, errors.New("buv: no path variable " + name)
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("buv: path variable " + name + "=" + value + " is not an integer")
+	}
+	return i, nil
+}
+
+// PathUUID returns the path variable as a lower case UUID in its canonical
+// xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx form, or an error if it is missing or not a UUID.
+func (h *HandlerData) PathUUID(name string) (string, error) {
+	value, ok := mux.Vars(h.r)[name]
+	if !ok {
+		return "", errors.New("buv: no path variable " + name)
+	}
+	if !isUUID(value) {
+		return "", errors.New("buv: path variable " + name + "=" + value + " is not a UUID")
+	}
+	return strings.ToLower(value), nil
+}
+
+// RequirePathInt is like PathInt, but answers the request with 400 Bad Request if the
+// conversion fails. It returns false if the request was answered.
+func (h *HandlerData) RequirePathInt(name string) (int, bool) {
+	i, err := h.PathInt(name)
+	if err != nil {
+		h.badRequest(err)
+		return 0, false
+	}
+	return i, true
+}
+
+// RequirePathUUID is like PathUUID, but answers the request with 400 Bad Request if the
+// conversion fails. It returns false if the request was answered.
+func (h *HandlerData) RequirePathUUID(name string) (string, bool) {
+	uuid, err := h.PathUUID(name)
+	if err != nil {
+		h.badRequest(err)
+		return "", false
+	}
+	return uuid, true
+}
+
 func (h *HandlerData) String() string {
 	return "Method=" + h.r.Method + " URL=" + h.r.URL.String() + " Scheme=" + h.r.URL.Scheme + " Host=" + h.r.URL.Host
 }
@@ -176,3 +368,125 @@ func (h *HandlerData) String() string {
 func (h *HandlerData) GetUrl(URLName string, pathVars map[string]string) *url.URL {
 	return h.server.GetUrl(URLName, pathVars)
 }
+
+// BuildURL builds the URL of the route registered with the URLName, as described by the
+// Server's BuildURL.
+func (h *HandlerData) BuildURL(URLName string, pairs ...string) (*url.URL, error) {
+	return h.server.BuildURL(URLName, pairs...)
+}
+
+// BuildAbsoluteURL builds the absolute URL of the route registered with the URLName, using the
+// scheme and host of the request unless the route was registered with a host of its own.
+func (h *HandlerData) BuildAbsoluteURL(URLName string, pairs ...string) (*url.URL, error) {
+	scheme := h.r.URL.Scheme
+	if scheme == "" {
+		scheme = HTTP_SCHEME
+		if h.r.TLS != nil {
+			scheme = HTTPS_SCHEME
+		}
+	}
+	return h.server.BuildAbsoluteURL(URLName, scheme, h.r.Host, pairs...)
+}
+
+// parseForm parses the request's form the first time it is called. It returns ErrRequestTooLarge
+// if the body exceeds its limit, or an error wrapping ErrMalformedForm if the body cannot be
+// parsed; a malformed query string only loses the values that cannot be parsed. If answer is set
+// such an error is also answered with 413 Request Entity Too Large or 400 Bad Request.
+func (h *HandlerData) parseForm(answer bool) error {
+	if !h.formParsed {
+		h.formParsed = true
+		h.formErr = h.readForm()
+	}
+	if answer {
+		return h.answerForm(h.formErr)
+	}
+	return h.formErr
+}
+
+// readForm reads the request's form, parsing its body apart from its query string so that only
+// the body's errors are returned.
+func (h *HandlerData) readForm() error {
+	if h.matching {
+		return h.matchingBody()
+	}
+	if mediaType, _, _ := mime.ParseMediaType(h.r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		return h.parseUploads().err
+	}
+	// A non-nil Form keeps ParseForm from parsing the query string.
+	h.r.Form = make(url.Values)
+	err := h.r.ParseForm()
+	h.setForm(h.r.PostForm)
+	if err != nil {
+		return h.formError(err)
+	}
+	return nil
+}
+
+// setForm sets the request's Form to the values of its body followed by those of its query
+// string.
+func (h *HandlerData) setForm(post url.Values) {
+	h.r.PostForm = post
+	h.r.Form = make(url.Values)
+	for key, values := range post {
+		h.r.Form[key] = append(h.r.Form[key], values...)
+	}
+	for key, values := range h.r.URL.Query() {
+		h.r.Form[key] = append(h.r.Form[key], values...)
+	}
+}
+
+// matchingBody logs an attempt by a matcher to read the request body, returning
+// ErrBodyWhileMatching.
+func (h *HandlerData) matchingBody() error {
+	h.server.Println("Matcher attempted to read the request body: " + h.String())
+	return ErrBodyWhileMatching
+}
+
+// formError returns ErrRequestTooLarge if the error reading the request body came from
+// exceeding its limit, or an error wrapping ErrMalformedForm otherwise.
+func (h *HandlerData) formError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || h.tooLarge {
+		return ErrRequestTooLarge
+	}
+	return fmt.Errorf("%w: %v", ErrMalformedForm, err)
+}
+
+// answerForm answers a request whose body is too large with 413 Request Entity Too Large, or
+// whose form cannot be parsed with 400 Bad Request, unless it has already been answered.
+func (h *HandlerData) answerForm(err error) error {
+	if err == nil || h.sw.answered != nil {
+		return err
+	}
+	if errors.Is(err, ErrRequestTooLarge) {
+		h.server.requestTooLarge(h)
+	} else if errors.Is(err, ErrMalformedForm) {
+		h.badRequest(err)
+		h.sw.answered = err
+	}
+	return err
+}
+
+func (h *HandlerData) badRequest(err error) {
+	h.server.Println("Bad request: " + err.Error() + ": " + h.String())
+	http.Error(h.w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
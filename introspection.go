@@ -0,0 +1,109 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"html/template"
+	"strings"
+)
+
+// RouteInfo describes a route registered with a Server.
+type RouteInfo struct {
+	Name        string   `json:"name"`
+	Path        string   `json:"path"`
+	Host        string   `json:"host,omitempty"`
+	Methods     []string `json:"methods,omitempty"`
+	Schemes     []string `json:"schemes,omitempty"`
+	Queries     []string `json:"queries,omitempty"`
+	Parent      string   `json:"parent,omitempty"`
+	Redirectors int      `json:"redirectors"`
+}
+
+// routeMeta records what was registered for a route that the mux.Route does not expose.
+type routeMeta struct {
+	schemes     []string
+	parent      string
+	redirectors int
+
+	// builder and router are what the route was built from and registered in, so that routes
+	// naming it as their Parent can be registered beneath it.
+	builder *RouteBuilder
+	router  *mux.Router
+}
+
+var routesTemplate = template.Must(template.New("routes").Funcs(template.FuncMap{
+	"join": func(s []string) string { return strings.Join(s, ", ") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Routes</title></head>
+<body>
+<table>
+<tr><th>Name</th><th>Path</th><th>Host</th><th>Methods</th><th>Schemes</th><th>Queries</th><th>Parent</th><th>Redirectors</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Path}}</td><td>{{.Host}}</td><td>{{join .Methods}}</td><td>{{join .Schemes}}</td><td>{{join .Queries}}</td><td>{{.Parent}}</td><td>{{.Redirectors}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Routes describes every route with a handler registered with the Server, in the order they are
+// matched against requests.
+func (b *Server) Routes() []RouteInfo {
+	var routes []RouteInfo
+	b.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		info := RouteInfo{Name: route.GetName()}
+		info.Path, _ = route.GetPathTemplate()
+		info.Host, _ = route.GetHostTemplate()
+		info.Methods, _ = route.GetMethods()
+		info.Queries, _ = route.GetQueriesTemplates()
+		if meta, ok := b.routeMeta[route]; ok {
+			info.Schemes = meta.schemes
+			info.Parent = meta.parent
+			info.Redirectors = meta.redirectors
+		}
+		routes = append(routes, info)
+		return nil
+	})
+	return routes
+}
+
+// RoutesHandler returns a HandlerFunction listing the Server's Routes as an HTML table, or as
+// JSON if the request has a "format=json" query or accepts "application/json". It is not
+// registered by default since it reveals the Server's structure; register it on a route guarded
+// by a suitable redirector to enable it.
+func (b *Server) RoutesHandler() HandlerFunction {
+	return func(data *HandlerData) {
+		routes := b.Routes()
+		if data.Query().Get("format") == "json" || strings.Contains(data.r.Header.Get("Accept"), "application/json") {
+			data.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			if err := json.NewEncoder(data.w).Encode(routes); err != nil {
+				b.logger.Println("RoutesHandler: " + err.Error())
+			}
+			return
+		}
+		data.w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := routesTemplate.Execute(data.w, routes); err != nil {
+			b.logger.Println("RoutesHandler: " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DEFAULT_MAX_JSON_BYTES limits the body read by BindJSON when neither the route nor the
+	// ServerOptions set a MaxBodyBytes.
+	DEFAULT_MAX_JSON_BYTES = 1 << 20
+
+	JSON_CONTENT_TYPE = "application/json; charset=utf-8"
+)
+
+// JSONError is the body of the 400 Bad Request response written when BindJSON cannot decode a
+// request body.
+type JSONError struct {
+	// Error describes what is wrong with the request body.
+	Error string `json:"error"`
+
+	// Field is the name of the offending field, if known.
+	Field string `json:"field,omitempty"`
+
+	// Offset is the byte offset in the request body at which decoding failed, if known.
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// WriteJSON writes the value encoded as JSON with the HTTP status code and a JSON Content-Type.
+// It returns an error if the value cannot be encoded, in which case nothing is written.
+func (h *HandlerData) WriteJSON(code int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		h.server.Println("WriteJSON: " + err.Error() + ": " + h.String())
+		return err
+	}
+	h.SetHeader("Content-Type", JSON_CONTENT_TYPE)
+	h.SetStatus(code)
+	_, err = h.w.Write(append(body, '\n'))
+	return err
+}
+
+// BindJSON decodes the JSON request body into the value pointed to by v, ignoring fields the
+// value does not have. The body is limited to the route's MaxBodyBytes, or to
+// DEFAULT_MAX_JSON_BYTES if no limit is set, and answered with 413 Request Entity Too Large if
+// it is larger. A body that cannot be decoded is answered with 400 Bad Request and a JSONError.
+// It returns false if the request was answered.
+func (h *HandlerData) BindJSON(v interface{}) bool {
+	return h.bindJSON(v, false)
+}
+
+// BindStrictJSON is like BindJSON, but also answers the request with 400 Bad Request if the body
+// has a field the value does not.
+func (h *HandlerData) BindStrictJSON(v interface{}) bool {
+	return h.bindJSON(v, true)
+}
+
+func (h *HandlerData) bindJSON(v interface{}, strict bool) bool {
+	if h.tooLarge {
+		return false
+	} else if h.matching {
+		h.matchingBody()
+		return false
+	}
+	body := h.r.Body
+	if h.server.bodyLimit(h.r) <= 0 {
+		body = http.MaxBytesReader(h.w, body, DEFAULT_MAX_JSON_BYTES)
+	}
+	decoder := json.NewDecoder(body)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err == nil && decoder.More() {
+		err = errors.New("request body must contain a single JSON value")
+	}
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.server.requestTooLarge(h)
+		return false
+	}
+	jsonErr := newJSONError(err)
+	h.server.Println("Bad JSON request: " + jsonErr.Error + ": " + h.String())
+	h.WriteJSON(http.StatusBadRequest, jsonErr)
+	return false
+}
+
+// newJSONError describes the error returned when decoding a request body.
+func newJSONError(err error) *JSONError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return &JSONError{Error: "request body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &JSONError{Error: "request body is truncated"}
+	case errors.As(err, &syntaxErr):
+		return &JSONError{Error: "malformed JSON: " + syntaxErr.Error(), Offset: syntaxErr.Offset}
+	case errors.As(err, &typeErr):
+		return &JSONError{Error: "field must be of type " + typeErr.Type.String(), Field: typeErr.Field, Offset: typeErr.Offset}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+		return &JSONError{Error: "unknown field", Field: field}
+	}
+	return &JSONError{Error: err.Error()}
+}
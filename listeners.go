@@ -0,0 +1,185 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// UNIX_ADDRESS_PREFIX prefixes an address to listen on a Unix domain socket at the
+	// path that follows, such as "unix:/run/app.sock".
+	UNIX_ADDRESS_PREFIX = "unix:"
+
+	// SYSTEMD_ADDRESS_PREFIX prefixes an address to serve on a socket passed in by systemd
+	// socket activation. "systemd:" uses the first socket, "systemd:1" the second, and
+	// "systemd:web" the socket named "web" by the FileDescriptorName of its unit.
+	SYSTEMD_ADDRESS_PREFIX = "systemd:"
+
+	systemdListenFdsStart = 3
+)
+
+// Bind describes an address for a Server to serve on.
+type Bind struct {
+	// Address is a TCP address such as ":8080", or an address prefixed by UNIX_ADDRESS_PREFIX or
+	// SYSTEMD_ADDRESS_PREFIX.
+	Address string
+
+	// TLS serves TLS on the Address using the certificates specified in the ServerOptions.
+	TLS bool
+
+	// Scheme is the scheme requests accepted on the Address are matched with against the schemes
+	// of registered handlers. A value of "" uses HTTPS_SCHEME if TLS is served, HTTP_SCHEME otherwise.
+	Scheme string
+}
+
+func (b Bind) scheme() string {
+	if b.Scheme != "" {
+		return b.Scheme
+	} else if b.TLS {
+		return HTTPS_SCHEME
+	}
+	return HTTP_SCHEME
+}
+
+// binding is a Bind that is being served on. A redirect binding redirects all requests to
+// HTTPS instead of handling them.
+type binding struct {
+	bind        Bind
+	rawListener net.Listener
+	listener    net.Listener
+	server      *http.Server
+	redirect    bool
+}
+
+// systemdSockets holds the sockets inherited through systemd socket activation. They are
+// read from the environment once and kept open so a Server may serve on them again after
+// being shut down.
+var systemdSockets struct {
+	once  sync.Once
+	files []*os.File
+	names []string
+}
+
+// listen opens a listener for the address, which is either a TCP address, a Unix domain
+// socket prefixed by UNIX_ADDRESS_PREFIX, or a socket activated by systemd prefixed by
+// SYSTEMD_ADDRESS_PREFIX. A socket handed down for the address by a restarting parent
+// process is used in preference to opening a new one.
+func (b *Server) listen(address string) (net.Listener, error) {
+	list, err := listenInherited(address)
+	if list != nil || err != nil {
+		if list != nil {
+			b.logger.Println("Using listener inherited from parent process for " + address)
+		}
+		return list, err
+	}
+	if strings.HasPrefix(address, UNIX_ADDRESS_PREFIX) {
+		return b.listenUnix(strings.TrimPrefix(address, UNIX_ADDRESS_PREFIX))
+	} else if strings.HasPrefix(address, SYSTEMD_ADDRESS_PREFIX) {
+		return listenSystemd(strings.TrimPrefix(address, SYSTEMD_ADDRESS_PREFIX))
+	}
+	return net.Listen("tcp", address)
+}
+
+// listenUnix listens on a Unix domain socket at the path. A socket file left at the path is
+// removed only if nothing answers on it; a live socket fails with EADDRINUSE.
+func (b *Server) listenUnix(path string) (net.Listener, error) {
+	if stat, err := os.Stat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, &net.OpError{Op: "listen", Net: "unix", Addr: &net.UnixAddr{Name: path, Net: "unix"}, Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+		} else if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		b.logger.Println("Removing stale Unix socket: " + path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	list, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if b.getOptions().SocketPermissions != 0 {
+		err = os.Chmod(path, b.getOptions().SocketPermissions)
+		if err != nil {
+			list.Close()
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func inheritSystemdSockets() {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" || os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		systemdSockets.files = append(systemdSockets.files, os.NewFile(uintptr(systemdListenFdsStart+i), name))
+		systemdSockets.names = append(systemdSockets.names, name)
+	}
+}
+
+// listenSystemd listens on the inherited socket identified by its index or name. An empty
+// identifier uses the first socket.
+func listenSystemd(identifier string) (net.Listener, error) {
+	systemdSockets.once.Do(inheritSystemdSockets)
+	if len(systemdSockets.files) == 0 {
+		return nil, errors.New("buv: no sockets passed by systemd (LISTEN_FDS is not set for this process)")
+	}
+	index := -1
+	if identifier == "" {
+		index = 0
+	} else if n, err := strconv.Atoi(identifier); err == nil {
+		index = n
+	} else {
+		for i, name := range systemdSockets.names {
+			if name == identifier {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 || index >= len(systemdSockets.files) {
+		return nil, errors.New("buv: no systemd socket " + identifier)
+	}
+	return net.FileListener(systemdSockets.files[index])
+}
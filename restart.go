@@ -0,0 +1,229 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Environment variables used to hand listening sockets from a restarting parent to its
+	// child. Sockets are passed starting at file descriptor 3 in the order of their addresses,
+	// followed by the pipe the child reports its readiness on. Each socket is listed both by
+	// the address it was bound with and by the address it resolved to.
+	envListenAddresses = "BUV_LISTEN_ADDRESSES"
+	envListenResolved  = "BUV_LISTEN_RESOLVED_ADDRESSES"
+	envReadyFd         = "BUV_READY_FD"
+
+	listenAddressSeparator = ","
+	inheritedFdsStart      = 3
+)
+
+// inheritedSocket is a socket handed down by a parent process that restarted.
+type inheritedSocket struct {
+	address  string
+	resolved string
+	file     *os.File
+}
+
+// inheritedSockets holds the sockets handed down by a parent process that restarted.
+var inheritedSockets struct {
+	once    sync.Once
+	sockets []*inheritedSocket
+	ready   *os.File
+}
+
+func inheritParentSockets() {
+	addresses := os.Getenv(envListenAddresses)
+	if addresses == "" {
+		return
+	}
+	resolved := strings.Split(os.Getenv(envListenResolved), listenAddressSeparator)
+	for i, address := range strings.Split(addresses, listenAddressSeparator) {
+		socket := &inheritedSocket{address: address, file: os.NewFile(uintptr(inheritedFdsStart+i), address)}
+		if i < len(resolved) {
+			socket.resolved = resolved[i]
+		}
+		inheritedSockets.sockets = append(inheritedSockets.sockets, socket)
+	}
+	if fd, err := strconv.Atoi(os.Getenv(envReadyFd)); err == nil {
+		inheritedSockets.ready = os.NewFile(uintptr(fd), "buv-ready")
+	}
+	os.Unsetenv(envListenAddresses)
+	os.Unsetenv(envListenResolved)
+	os.Unsetenv(envReadyFd)
+}
+
+// listenInherited returns the listener handed down by the parent process for the address,
+// or nil if there is none. A socket matches if it was bound with or resolved to the address,
+// or if it is a TCP socket on the address's port and the address's host is empty, unspecified
+// or the socket's host, so ":8080" finds a socket the parent served on "127.0.0.1:8080".
+func listenInherited(address string) (net.Listener, error) {
+	inheritedSockets.once.Do(inheritParentSockets)
+	match := -1
+	for i, socket := range inheritedSockets.sockets {
+		if socket.address == address || socket.resolved == address {
+			match = i
+			break
+		} else if match < 0 && sameTCPAddress(address, socket.resolved) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, nil
+	}
+	return net.FileListener(inheritedSockets.sockets[match].file)
+}
+
+// sameTCPAddress returns whether listening on the requested TCP address would bind the port
+// of the resolved address.
+func sameTCPAddress(requested, resolved string) bool {
+	if resolved == "" || strings.HasPrefix(requested, UNIX_ADDRESS_PREFIX) || strings.HasPrefix(requested, SYSTEMD_ADDRESS_PREFIX) {
+		return false
+	}
+	want, err := net.ResolveTCPAddr("tcp", requested)
+	if err != nil {
+		return false
+	}
+	have, err := net.ResolveTCPAddr("tcp", resolved)
+	if err != nil || want.Port != have.Port {
+		return false
+	}
+	return want.IP == nil || want.IP.IsUnspecified() || want.IP.Equal(have.IP)
+}
+
+// notifyParentReady tells a restarting parent process that this process is serving, so the
+// parent may begin draining its requests. It does nothing if this process was not started
+// by a restart.
+func notifyParentReady() {
+	inheritedSockets.once.Do(inheritParentSockets)
+	if inheritedSockets.ready == nil {
+		return
+	}
+	inheritedSockets.ready.Write([]byte{1})
+	inheritedSockets.ready.Close()
+	inheritedSockets.ready = nil
+}
+
+// Restart hands the Server's listening sockets to a new instance of the running executable,
+// started with the same arguments and environment. Once the new process calls Start or
+// StartBinds with the same addresses and begins serving, this Server is gracefully shut down
+// by ShutdownContext, so no connections are refused during the switch. If the new process
+// exits or the context is done before it is ready, it is killed and this Server keeps serving.
+//
+// The caller should exit once Restart returns successfully.
+func (b *Server) Restart(ctx context.Context) (forceClosed int, e error) {
+	b.mutex.Lock()
+	if !b.running {
+		b.mutex.Unlock()
+		return 0, ErrServerNotStarted
+	}
+	bindings := b.bindings
+	b.mutex.Unlock()
+
+	b.logger.Println("Begin *Server Restart*")
+	addresses := make([]string, 0, len(bindings))
+	resolved := make([]string, 0, len(bindings))
+	files := make([]*os.File, 0, len(bindings)+1)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, bound := range bindings {
+		filer, ok := bound.rawListener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return 0, errors.New("buv: listener on " + bound.bind.Address + " cannot be handed to a new process")
+		}
+		file, err := filer.File()
+		if err != nil {
+			return 0, err
+		}
+		addresses = append(addresses, bound.bind.Address)
+		resolved = append(resolved, bound.rawListener.Addr().String())
+		files = append(files, file)
+	}
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyRead.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyWrite.Close()
+		return 0, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWrite)
+	cmd.Env = append(os.Environ(),
+		envListenAddresses+"="+strings.Join(addresses, listenAddressSeparator),
+		envListenResolved+"="+strings.Join(resolved, listenAddressSeparator),
+		envReadyFd+"="+strconv.Itoa(inheritedFdsStart+len(files)))
+	b.logger.Println("Starting new process: " + executable)
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return 0, err
+	}
+	b.logger.Println("Waiting for new process to become ready, pid=" + strconv.Itoa(cmd.Process.Pid))
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyRead.Read(buf)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = errors.New("buv: new process exited before becoming ready: " + err.Error())
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		b.logger.Println("Restart error: " + err.Error())
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	cmd.Process.Release()
+	b.logger.Println("New process is ready, draining this process.")
+
+	for _, bound := range bindings {
+		if unixList, ok := bound.rawListener.(*net.UnixListener); ok {
+			unixList.SetUnlinkOnClose(false)
+		}
+	}
+	return b.ShutdownContext(ctx)
+}
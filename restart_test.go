@@ -0,0 +1,160 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	// restartChildEnv gates TestRestart into serving as the restarted child process, on the
+	// address it names.
+	restartChildEnv = "BUV_TEST_RESTART_CHILD_ADDRESS"
+)
+
+// newTestServer creates a Server logging to and loading templates from a temporary directory.
+func newTestServer(t *testing.T) *Server {
+	dir, err := ioutil.TempDir("", "buv-restart-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	server, err := NewServer(&ServerOptions{
+		FileLog:               "buv",
+		DirectoryLog:          dir + string(os.PathSeparator),
+		FilePermissions:       0644,
+		DirectoryPermissions:  0755,
+		TemplatePath:          dir,
+		TemplateExtension:     ".html",
+		CookiePath:            "/",
+		GenerateKeys:          true,
+		AuthenticationKeySize: 32,
+		EncryptionKeySize:     32,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func newRestartTestServer(t *testing.T) *Server {
+	server := newTestServer(t)
+	err := server.Route("/pid").Handle(func(data *HandlerData) {
+		data.WriteResponse(strconv.Itoa(os.Getpid()))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func getPid(t *testing.T, address string) int {
+	resp, err := http.Get("http://" + address + "/pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+// TestRestart re-executes the test binary as the restarted child, which asks for the port
+// alone while the parent served on a resolved loopback address, and checks that the child
+// answers on the handed down socket.
+func TestRestart(t *testing.T) {
+	if address := os.Getenv(restartChildEnv); address != "" {
+		runRestartChild(t, address)
+		return
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_, port, _ := net.SplitHostPort(address)
+	parent := newRestartTestServer(t)
+	if err := parent.StartListener(listener, nil); err != nil {
+		t.Fatal(err)
+	}
+	if pid := getPid(t, address); pid != os.Getpid() {
+		t.Fatalf("parent served pid %d, want %d", pid, os.Getpid())
+	}
+
+	os.Setenv(restartChildEnv, ":"+port)
+	defer os.Unsetenv(restartChildEnv)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := parent.Restart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pid := getPid(t, address)
+	if pid == os.Getpid() {
+		t.Fatalf("parent still serving after restart")
+	}
+	// Tell the child to stop serving now that it has been checked.
+	resp, err := http.Get("http://" + address + "/quit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+// runRestartChild serves on the address with a socket inherited from TestRestart until asked
+// to quit, failing if it had to open a new socket.
+func runRestartChild(t *testing.T, address string) {
+	inherited, err := listenInherited(address)
+	if err != nil || inherited == nil {
+		t.Fatalf("no socket inherited for %s: %v", address, err)
+	}
+	inherited.Close()
+	child := newRestartTestServer(t)
+	quit := make(chan struct{})
+	err = child.Route("/quit").Handle(func(data *HandlerData) {
+		data.WriteResponse("bye")
+		close(quit)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Start(address, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-quit:
+	case <-time.After(30 * time.Second):
+		t.Error("child was never told to quit")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	child.ShutdownContext(ctx)
+}
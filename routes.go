@@ -0,0 +1,377 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RouteBuilder describes a handler to register with a Server. It is created by Server.Route,
+// configured by chaining its methods, and registered by Handle:
+//
+//	err := s.Route("/users/{id}").Name("user").Methods("GET").Schemes("https").Guard(auth).Handle(fn)
+//
+// A RouteBuilder must not be reused after Handle is called.
+type RouteBuilder struct {
+	server       *Server
+	group        *Group
+	path         string
+	name         string
+	parent       string
+	host         string
+	schemes      []string
+	methods      []string
+	queries      []string
+	headers      []string
+	headerRegexp []string
+	matchers     []mux.MatcherFunc
+	redirectors  []Redirector
+	middleware   []Middleware
+	maxBodyBytes int64
+	hasMaxBody   bool
+	uploads      *UploadOptions
+	err          error
+}
+
+// Route begins describing a handler for the path, which may contain gorilla-mux style
+// variables such as "/users/{id}" or "/users/{id:[0-9]+}".
+func (b *Server) Route(path string) *RouteBuilder {
+	return &RouteBuilder{server: b, path: path}
+}
+
+// Name gives the route a unique name so its URL can be reconstructed by GetUrl, and so it can
+// be the parent of other routes.
+func (r *RouteBuilder) Name(URLName string) *RouteBuilder {
+	r.name = URLName
+	return r
+}
+
+// Parent registers the route beneath the route registered with the URLName. The parent's path
+// prefixes this route's path, and this route only matches requests that also match the
+// parent's host, schemes, methods, queries and headers. The parent keeps matching requests for
+// its own path.
+func (r *RouteBuilder) Parent(URLName string) *RouteBuilder {
+	r.parent = URLName
+	return r
+}
+
+// Host restricts the route to requests for the host, which may contain variables such as
+// "{subdomain}.example.com".
+func (r *RouteBuilder) Host(host string) *RouteBuilder {
+	r.host = host
+	return r
+}
+
+// Schemes restricts the route to requests made with one of the schemes, such as HTTP_SCHEME
+// or HTTPS_SCHEME.
+func (r *RouteBuilder) Schemes(schemes ...string) *RouteBuilder {
+	r.schemes = append(r.schemes, schemes...)
+	return r
+}
+
+// Methods restricts the route to requests made with one of the HTTP methods, such as
+// HTTP_METHOD_GET.
+func (r *RouteBuilder) Methods(methods ...string) *RouteBuilder {
+	r.methods = append(r.methods, methods...)
+	return r
+}
+
+// Queries restricts the route to requests with the query keys and values given as pairs. A
+// value may contain variables such as "{page:[0-9]+}", and a value of "" matches any value.
+func (r *RouteBuilder) Queries(pairs ...string) *RouteBuilder {
+	if len(pairs)%2 != 0 {
+		r.fail("Queries requires key and value pairs")
+	}
+	r.queries = append(r.queries, pairs...)
+	return r
+}
+
+// Headers restricts the route to requests with the header keys and values given as pairs. A
+// value of "" matches any value.
+func (r *RouteBuilder) Headers(pairs ...string) *RouteBuilder {
+	if len(pairs)%2 != 0 {
+		r.fail("Headers requires key and value pairs")
+	}
+	r.headers = append(r.headers, pairs...)
+	return r
+}
+
+// HeadersRegexp restricts the route to requests with the header keys and values given as pairs,
+// where each value is a regular expression the header must match.
+func (r *RouteBuilder) HeadersRegexp(pairs ...string) *RouteBuilder {
+	if len(pairs)%2 != 0 {
+		r.fail("HeadersRegexp requires key and regular expression pairs")
+	}
+	r.headerRegexp = append(r.headerRegexp, pairs...)
+	return r
+}
+
+// Match restricts the route to requests for which the matcher returns true. The matcher is
+// called before the request is routed, possibly several times, so its HandlerData is a read only
+// view of the request: its method, headers, URL, query, path variables and session values. Its
+// methods reading the request body fail with ErrBodyWhileMatching, leaving the body for the
+// handler, and anything it writes to the response, including session changes, is discarded.
+func (r *RouteBuilder) Match(matcher func(data *HandlerData) bool) *RouteBuilder {
+	b := r.server
+	r.matchers = append(r.matchers, func(req *http.Request, match *mux.RouteMatch) bool {
+		sw := &statusWriter{ResponseWriter: &discardWriter{}, status: http.StatusOK}
+		return matcher(&HandlerData{w: sw, r: req, server: b, sw: sw, matching: true})
+	})
+	return r
+}
+
+// Accepts restricts the route to requests whose Accept header lists one of the media types,
+// either exactly or by a range such as "application/*", with a non-zero quality. A "*/*" range
+// alone does not match, so a route accepting "application/json" may be registered before a route
+// serving HTML to browsers for the same path. Requests without an Accept header match.
+func (r *RouteBuilder) Accepts(mediaTypes ...string) *RouteBuilder {
+	r.matchers = append(r.matchers, func(req *http.Request, match *mux.RouteMatch) bool {
+		return acceptsMediaType(req.Header.Get("Accept"), mediaTypes)
+	})
+	return r
+}
+
+// ContentTypes restricts the route to requests whose Content-Type header is one of the media
+// types, ignoring any parameters such as the charset.
+func (r *RouteBuilder) ContentTypes(mediaTypes ...string) *RouteBuilder {
+	r.matchers = append(r.matchers, func(req *http.Request, match *mux.RouteMatch) bool {
+		contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil {
+			return false
+		}
+		for _, mediaType := range mediaTypes {
+			if strings.EqualFold(contentType, mediaType) {
+				return true
+			}
+		}
+		return false
+	})
+	return r
+}
+
+// Guard adds redirectors that act as a gateway before calling the handler. The handler is not
+// called if one of the redirectors redirects.
+func (r *RouteBuilder) Guard(redirectors ...Redirector) *RouteBuilder {
+	r.redirectors = append(r.redirectors, redirectors...)
+	return r
+}
+
+// Use adds middleware wrapping only this route's handler and redirectors. It is applied inside
+// any Server or Group middleware.
+func (r *RouteBuilder) Use(middleware ...Middleware) *RouteBuilder {
+	r.middleware = append(r.middleware, middleware...)
+	return r
+}
+
+// MaxBodyBytes overrides the ServerOptions' MaxBodyBytes for the route, which must be named.
+func (r *RouteBuilder) MaxBodyBytes(maxBytes int64) *RouteBuilder {
+	r.maxBodyBytes = maxBytes
+	r.hasMaxBody = true
+	return r
+}
+
+// Uploads sets the UploadOptions limiting the files uploaded to the route, which must be named.
+func (r *RouteBuilder) Uploads(options UploadOptions) *RouteBuilder {
+	r.uploads = &options
+	return r
+}
+
+// Handle validates the route and registers the handler function for it. It returns an error,
+// without registering the handler, if the route is malformed, its name is already registered
+// or its parent is not found.
+func (r *RouteBuilder) Handle(handleFunc HandlerFunction) error {
+	b := r.server
+	if handleFunc == nil {
+		return r.error("no handler function")
+	} else if err := r.validate(nil); err != nil {
+		return err
+	}
+	router := b.router
+	redirectors := r.redirectors
+	if r.group != nil {
+		router = r.group.muxRouter()
+		redirectors = append(append([]Redirector{}, r.group.allRedirectors()...), r.redirectors...)
+	} else if r.parent != "" {
+		parent, err := b.parentRouter(r.parent)
+		if err != nil {
+			return r.error(err.Error())
+		}
+		router = parent
+	}
+	route, err := r.build(router, false)
+	if err != nil {
+		return err
+	}
+	if r.name != "" {
+		route.Name(r.name)
+	}
+	handler := chain(redirectOrHandler(handleFunc, redirectors...), r.middleware)
+	var templates *hostTemplates
+	if r.group != nil {
+		handler = r.group.wrap(handler)
+		templates = r.group.templateWatcher()
+	}
+	route.HandlerFunc(b.templateHandler(handler, templates))
+	builder := *r
+	b.routeMeta[route] = &routeMeta{r.schemes, r.parent, len(redirectors), &builder, router}
+	if r.hasMaxBody {
+		b.SetMaxBodyBytes(r.name, r.maxBodyBytes)
+	}
+	if r.uploads != nil {
+		b.SetUploadOptions(r.name, *r.uploads)
+	}
+	b.logger.Println("Route " + r.String())
+	return nil
+}
+
+// HandleError validates the route and registers the error returning handler function for it, as
+// Handle does. Errors it returns are rendered by the Server's ErrorRenderer.
+func (r *RouteBuilder) HandleError(handleFunc ErrorHandlerFunction) error {
+	if handleFunc == nil {
+		return r.error("no handler function")
+	}
+	return r.Handle(r.server.ErrorHandler(handleFunc))
+}
+
+// validate returns the error Handle would return for the route, without registering it. The
+// parent may be one of the pending routes about to be registered before this one.
+func (r *RouteBuilder) validate(pending map[string]bool) error {
+	if err := r.check(pending); err != nil {
+		return err
+	}
+	_, err := r.build(mux.NewRouter(), false)
+	return err
+}
+
+// check returns an error if the route's options cannot be registered together, or if its name
+// or parent conflict with the registered or pending routes.
+func (r *RouteBuilder) check(pending map[string]bool) error {
+	b := r.server
+	if r.err != nil {
+		return r.err
+	} else if r.hasMaxBody && r.name == "" {
+		return r.error("MaxBodyBytes requires a Name")
+	} else if r.uploads != nil && r.name == "" {
+		return r.error("Uploads requires a Name")
+	} else if r.name != "" && b.router.Get(r.name) != nil {
+		return r.error("name " + r.name + " is already registered")
+	} else if r.group != nil && r.parent != "" {
+		return r.error("Parent cannot be used within a Group")
+	} else if r.group == nil && r.parent != "" && !pending[r.parent] && b.router.Get(r.parent) == nil {
+		return r.error("parent " + r.parent + " not found")
+	}
+	return nil
+}
+
+// build adds the route to the router with its matchers, returning an error if it is malformed.
+// A prefix route matches any path beginning with the route's path.
+func (r *RouteBuilder) build(router *mux.Router, prefix bool) (*mux.Route, error) {
+	route := router.NewRoute()
+	if prefix {
+		route.PathPrefix(r.path)
+	} else {
+		route.Path(r.path)
+	}
+	if r.host != "" {
+		route.Host(r.host)
+	}
+	if len(r.schemes) > 0 {
+		route.Schemes(r.schemes...)
+	}
+	if len(r.methods) > 0 {
+		route.Methods(r.methods...)
+	}
+	if len(r.queries) > 0 {
+		route.Queries(r.queries...)
+	}
+	if len(r.headers) > 0 {
+		route.Headers(r.headers...)
+	}
+	if len(r.headerRegexp) > 0 {
+		route.HeadersRegexp(r.headerRegexp...)
+	}
+	for _, matcher := range r.matchers {
+		route.MatcherFunc(matcher)
+	}
+	if err := route.GetError(); err != nil {
+		return nil, r.error(err.Error())
+	}
+	return route, nil
+}
+
+// String describes the route as it is logged when registered.
+func (r *RouteBuilder) String() string {
+	prefix := ""
+	for group := r.group; group != nil; group = group.parent {
+		prefix = group.prefix + prefix
+	}
+	return "schemes=" + strings.Join(r.schemes, ":") +
+		", URLName=" + r.name +
+		", path=" + prefix + r.path +
+		", host=" + r.host +
+		", methods=" + strings.Join(r.methods, ":") +
+		", queries=" + strings.Join(r.queries, ":") +
+		", headers=" + strings.Join(r.headers, ":") +
+		", headersRegexp=" + strings.Join(r.headerRegexp, ":") +
+		", matchers=" + strconv.Itoa(len(r.matchers)) +
+		", parent=" + r.parent +
+		", redirectors=" + strconv.Itoa(len(r.redirectors)) +
+		", middleware=" + strconv.Itoa(len(r.middleware))
+}
+
+func (r *RouteBuilder) fail(message string) {
+	if r.err == nil {
+		r.err = r.error(message)
+	}
+}
+
+func (r *RouteBuilder) error(message string) error {
+	return errors.New("buv: route " + r.path + ": " + message)
+}
+
+// acceptsMediaType reports whether the Accept header lists one of the media types, as described
+// by Accepts.
+func acceptsMediaType(accept string, mediaTypes []string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, accepted := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || mediaRange == "*/*" {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if quality, err := strconv.ParseFloat(q, 64); err != nil || quality <= 0 {
+				continue
+			}
+		}
+		for _, mediaType := range mediaTypes {
+			mediaType = strings.ToLower(mediaType)
+			if mediaRange == mediaType || (strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveTestRequest(server *Server, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// TestParentRoutes checks that a parent route keeps serving its own path once children are
+// registered beneath it, in code and in the config file.
+func TestParentRoutes(t *testing.T) {
+	server := newTestServer(t)
+	handler := func(response string) HandlerFunction {
+		return func(data *HandlerData) {
+			data.WriteResponse(response + data.PathVar("id"))
+		}
+	}
+	if err := server.Route("/users").Name("users").Methods(HTTP_METHOD_GET).Handle(handler("list")); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Route("/{id:[0-9]+}").Name("user").Parent("users").Handle(handler("user")); err != nil {
+		t.Fatal(err)
+	}
+	server.RegisterHandler("posts", handler("posts"))
+	server.options.Routes = []RouteConfig{{Path: "/{id:[0-9]+}/posts", Name: "posts", Parent: "users", Handler: "posts"}}
+	if err := server.RegisterConfigRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+		body   string
+	}{
+		{HTTP_METHOD_GET, "/users", http.StatusOK, "list"},
+		{HTTP_METHOD_GET, "/users/3", http.StatusOK, "user3"},
+		{HTTP_METHOD_GET, "/users/3/posts", http.StatusOK, "posts3"},
+		{HTTP_METHOD_GET, "/users/x", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := serveTestRequest(server, test.method, test.target)
+		if w.Code != test.code || (test.body != "" && w.Body.String() != test.body) {
+			t.Errorf("%s %s: got %d %q, want %d %q", test.method, test.target, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+	if u, err := server.BuildURL("user", "id", "3"); err != nil || u.String() != "/users/3" {
+		t.Errorf("BuildURL(user) = %v, %v, want /users/3", u, err)
+	}
+}
@@ -0,0 +1,173 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bitbucket.org/cjslep/goTem"
+	"context"
+	"gopkg.in/v1/yaml"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Run starts up the web service like Start and blocks until it stops. A SIGINT or SIGTERM
+// gracefully shuts the Server down, waiting up to the ServerOptions' ShutdownTimeout for
+// in-flight requests, and a SIGHUP calls Reload. It returns the error serving ended with, or
+// the error shutting down if in-flight requests had to be forcibly closed.
+func (b *Server) Run(address string, assetFolderToExtension map[string]string) error {
+	err := b.Start(address, assetFolderToExtension)
+	if err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- b.Wait()
+	}()
+	for {
+		select {
+		case err := <-served:
+			b.logger.Println("Run: serving ended, shutting down.")
+			b.ShutdownContext(context.Background())
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				b.logger.Println("Run: received " + sig.String() + ", reloading.")
+				if err := b.Reload(); err != nil {
+					b.logger.Println("Run: error reloading: " + err.Error())
+				}
+				continue
+			}
+			b.logger.Println("Run: received " + sig.String() + ", shutting down.")
+			ctx := context.Background()
+			if timeout := b.getOptions().ShutdownTimeout; timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+				defer cancel()
+			}
+			forceClosed, shutdownErr := b.ShutdownContext(ctx)
+			if err := <-served; err != nil {
+				return err
+			} else if shutdownErr != nil {
+				return &ShutdownError{forceClosed, shutdownErr}
+			}
+			return nil
+		}
+	}
+}
+
+// Reload reopens the log file, reloads the template files of the Server and its virtual hosts
+// and, if the Server was created by NewServerFromConfig, re-reads the config file. The virtual
+// hosts keep the TemplatePath they were created with. Of the re-read ServerOptions, the cookie,
+// template, body size and upload limit, redirect, HSTS, error template and shutdown timeout
+// options take effect immediately, and the timeouts, RedirectAddress and SocketPermissions the
+// next time the Server is started. The log file location, the cookie keys, the TLS options and
+// the Routes are fixed when the Server is created and are not changed by Reload.
+func (b *Server) Reload() error {
+	defer b.logger.Println(trackElapsed(time.Now(), "*Server Reload*"))
+	b.logger.Println("Begin *Server Reload*")
+	b.logger.Println("Reopening the log file.")
+	b.logger.Stop()
+	b.logger.Start()
+
+	options := b.getOptions()
+	if b.configPath != "" {
+		b.logger.Println("Reloading config file: " + b.configPath)
+		bytes, err := ioutil.ReadFile(b.configPath)
+		if err != nil {
+			return err
+		}
+		var opts ServerOptions
+		err = yaml.Unmarshal(bytes, &opts)
+		if err != nil {
+			return err
+		}
+		// Keep the options fixed at creation, so getOptions reports what is in effect.
+		opts.FileLog = options.FileLog
+		opts.DirectoryLog = options.DirectoryLog
+		opts.FilePermissions = options.FilePermissions
+		opts.DirectoryPermissions = options.DirectoryPermissions
+		opts.KeyPairs = options.KeyPairs
+		opts.CertificateFile = options.CertificateFile
+		opts.KeyFile = options.KeyFile
+		opts.CertificateReloadInterval = options.CertificateReloadInterval
+		opts.TLSConfig = options.TLSConfig
+		opts.Routes = options.Routes
+		options = &opts
+	} else {
+		b.logger.Println("Not created from a config file, keeping current configuration.")
+	}
+
+	b.logger.Println("Reloading templates from: " + options.TemplatePath)
+	watcher, err := goTem.NewHTMLTemplateWatcher(options.TemplatePath, options.TemplateExtension, b.logger)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	running := b.running
+	hosts := append([]*hostTemplates{}, b.hostTemplates...)
+	b.mutex.Unlock()
+	if running {
+		watcher.Start()
+	}
+	hostWatchers := make([]*goTem.HTMLTemplateWatcher, len(hosts))
+	for i, host := range hosts {
+		b.logger.Println("Reloading virtual host templates from: " + host.path)
+		hostWatchers[i], err = goTem.NewHTMLTemplateWatcher(host.path, host.extension, b.logger)
+		if err != nil {
+			if running {
+				watcher.Stop()
+				for _, started := range hostWatchers[:i] {
+					started.Stop()
+				}
+			}
+			return err
+		}
+		if running {
+			hostWatchers[i].Start()
+		}
+	}
+
+	b.optionsMutex.Lock()
+	old := b.templateManager
+	b.templateManager = watcher
+	oldHosts := make([]*goTem.HTMLTemplateWatcher, len(hosts))
+	for i, host := range hosts {
+		oldHosts[i] = host.watcher
+		host.watcher = hostWatchers[i]
+	}
+	b.options = options
+	b.cookieStore = newCookieStore(options)
+	b.optionsMutex.Unlock()
+	if running {
+		old.Stop()
+		for _, oldHost := range oldHosts {
+			oldHost.Stop()
+		}
+	}
+	b.logger.Println("Reloaded with MaxBodyBytes=" + strconv.FormatInt(options.MaxBodyBytes, 10) + ", HSTSMaxAge=" + strconv.Itoa(options.HSTSMaxAge))
+	return nil
+}
@@ -25,13 +25,17 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,17 +48,40 @@ import (
 //   - Constructing data-driven URLs
 //   - Handling session values and flash messages
 //   - New, re-used, or rotated secure cookie keys
+//   - Serving HTTPS with certificates that are reloaded when rotated on disk
 // A Server does not directly interact with the handlers, instead it exposes a limited
 // subset of its interface through a HandlerData that contains additional request
 // information beyond what the sole Server provides.
+//
+// Each Server serves with its own router and http.Server, so several Servers may run side
+// by side in one process and a Server may be used as a http.Handler by another program.
 type Server struct {
 	templateManager *goTem.HTMLTemplateWatcher
 	handlers        map[string]HandlerFunction
 	logger          *dailyLogger.DailyLogger
-	listener        net.Listener
-	servNotifier    chan bool
+	bindings        []*binding
+	running         bool
+	servNotifier    chan struct{}
+	serveErr        error
 	cookieStore     *sessions.CookieStore
 	router          *mux.Router
+	tlsConfig       *tls.Config
+	certReloader    *certificateReloader
+	inFlight        int64
+	assetPatterns   map[string]bool
+	options         *ServerOptions
+	configPath      string
+	optionsMutex    sync.RWMutex
+	bodyLimits      map[string]int64
+	uploadOptions   map[string]UploadOptions
+	errorRenderer   ErrorRenderer
+	parentRouters   map[string]*mux.Router
+	middleware      []Middleware
+	redirectors     map[string]Redirector
+	routesLoaded    bool
+	routeMeta       map[*mux.Route]*routeMeta
+	hostTemplates   []*hostTemplates
+	mutex           sync.Mutex
 }
 
 // BuvServerOptions is a structure for defining the parameters used when creating a new
@@ -114,6 +141,95 @@ type ServerOptions struct {
 
 	// The extension used by the template files
 	TemplateExtension string
+
+	// CertificateFile is the path to the PEM encoded certificate (or certificate chain) to
+	// serve HTTPS with. If both CertificateFile and KeyFile are specified, Start serves TLS.
+	CertificateFile string
+
+	// KeyFile is the path to the PEM encoded private key matching the CertificateFile.
+	KeyFile string
+
+	// CertificateReloadInterval is how often, in seconds, the CertificateFile and KeyFile are
+	// checked for changes. A changed pair is loaded for new connections without dropping the
+	// existing ones. A value of 0 checks once a minute.
+	CertificateReloadInterval int
+
+	// TLSConfig is an optional in-memory TLS configuration. If no CertificateFile and KeyFile
+	// are specified it is used as-is and must provide its own certificates, otherwise it is
+	// used as the base configuration for the certificate pair on disk. It is never saved to
+	// the config file.
+	TLSConfig *tls.Config `yaml:"-"`
+
+	// SocketPermissions specifies the permissions of a Unix domain socket created when serving
+	// on a "unix:" address. A value of 0 leaves the permissions determined by the umask.
+	SocketPermissions os.FileMode
+
+	// ReadTimeout is the maximum duration, in seconds, for reading an entire request including
+	// the body. A value of 0 means no timeout.
+	ReadTimeout int
+
+	// ReadHeaderTimeout is the maximum duration, in seconds, for reading the request headers.
+	// A value of 0 uses the ReadTimeout.
+	ReadHeaderTimeout int
+
+	// WriteTimeout is the maximum duration, in seconds, before timing out writes of the
+	// response. A value of 0 means no timeout.
+	WriteTimeout int
+
+	// IdleTimeout is the maximum duration, in seconds, to wait for the next request on a
+	// keep-alive connection. A value of 0 uses the ReadTimeout.
+	IdleTimeout int
+
+	// MaxHeaderBytes is the maximum number of bytes read parsing the request headers. A value
+	// of 0 uses the net/http default of 1 MB.
+	MaxHeaderBytes int
+
+	// MaxBodyBytes is the default maximum number of bytes of a request body handlers may read.
+	// Requests exceeding it are answered with 413 Request Entity Too Large. A value of 0 means
+	// no limit. It may be overridden per route with SetMaxBodyBytes.
+	MaxBodyBytes int64
+
+	// MaxUploadBytes is the default maximum size of each file uploaded with a multipart form.
+	// Larger files are rejected with ErrUploadTooLarge. A value of 0 limits them only by
+	// MaxBodyBytes. It may be overridden per route with SetUploadOptions.
+	MaxUploadBytes int64
+
+	// UploadDirectory is the directory uploaded files are streamed to while a request is handled.
+	// A value of "" uses the system's temporary directory.
+	UploadDirectory string
+
+	// RedirectAddress is an optional address served alongside the Server's binds that answers
+	// every plain HTTP request with a redirect to the same path and query over HTTPS. A value of
+	// "" does not serve redirects.
+	RedirectAddress string
+
+	// RedirectHTTPSPort is the port redirected requests are sent to. A value of "" uses the
+	// default HTTPS port.
+	RedirectHTTPSPort string
+
+	// HSTSMaxAge is the max-age, in seconds, of the Strict-Transport-Security header sent with
+	// every HTTPS response. A value of 0 does not send the header.
+	HSTSMaxAge int
+
+	// HSTSIncludeSubdomains adds the includeSubDomains directive to the Strict-Transport-Security
+	// header.
+	HSTSIncludeSubdomains bool
+
+	// HSTSPreload adds the preload directive to the Strict-Transport-Security header.
+	HSTSPreload bool
+
+	// ShutdownTimeout is how long, in seconds, Run waits for in-flight requests to finish when
+	// shutting down before forcibly closing them. A value of 0 waits indefinitely.
+	ShutdownTimeout int
+
+	// ErrorTemplate is the name of the template rendered for errors returned by an
+	// ErrorHandlerFunction, given an ErrorPage. A value of "" answers with plain text.
+	ErrorTemplate string
+
+	// Routes are registered when the Server is started, resolving their handlers and redirectors
+	// by the names given to RegisterHandler and RegisterRedirector. Starting fails if any name
+	// was not registered.
+	Routes []RouteConfig
 }
 
 // NewServerFromConfig creates a new Server from a JSON file representing a ServerOptions
@@ -128,7 +244,23 @@ func NewServerFromConfig(configPath string) (w *Server, e error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewServer(&opts)
+	server, err := NewServer(&opts)
+	if err != nil {
+		return nil, err
+	}
+	server.configPath = configPath
+	return server, nil
+}
+
+// newCookieStore creates the session store described by the ServerOptions.
+func newCookieStore(options *ServerOptions) *sessions.CookieStore {
+	store := sessions.NewCookieStore(options.KeyPairs...)
+	store.Options = &sessions.Options{
+		Path:     options.CookiePath,
+		MaxAge:   options.MaxAge,
+		HttpOnly: options.HttpOnly,
+	}
+	return store
 }
 
 // NewServer creates a new web Server from the specified options. It returns a non-nil error
@@ -136,23 +268,38 @@ func NewServerFromConfig(configPath string) (w *Server, e error) {
 func NewServer(options *ServerOptions) (w *Server, e error) {
 	logger := dailyLogger.NewDailyLogger(options.FileLog, options.DirectoryLog, options.FilePermissions, options.DirectoryPermissions)
 	logger.Start()
-	var tempStore *sessions.CookieStore
 	if options.GenerateKeys {
 		options.KeyPairs = append(options.KeyPairs, []byte(securecookie.GenerateRandomKey(options.AuthenticationKeySize)))
 		options.KeyPairs = append(options.KeyPairs, []byte(securecookie.GenerateRandomKey(options.EncryptionKeySize)))
 	}
-	tempStore = sessions.NewCookieStore(options.KeyPairs...)
-	tempStore.Options = &sessions.Options{
-		Path:     options.CookiePath,
-		MaxAge:   options.MaxAge,
-		HttpOnly: options.HttpOnly,
-	}
+	tempStore := newCookieStore(options)
 	watcher, err := goTem.NewHTMLTemplateWatcher(options.TemplatePath, options.TemplateExtension, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	server := Server{watcher, make(map[string]HandlerFunction), logger, nil, nil, tempStore, mux.NewRouter()}
+	tlsConfig, reloader, err := newTLSConfig(options, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	server := Server{
+		templateManager: watcher,
+		handlers:        make(map[string]HandlerFunction),
+		logger:          logger,
+		cookieStore:     tempStore,
+		router:          mux.NewRouter(),
+		tlsConfig:       tlsConfig,
+		certReloader:    reloader,
+		assetPatterns:   make(map[string]bool),
+		options:         options,
+		bodyLimits:      make(map[string]int64),
+		uploadOptions:   make(map[string]UploadOptions),
+		parentRouters:   make(map[string]*mux.Router),
+		redirectors:     make(map[string]Redirector),
+		routeMeta:       make(map[*mux.Route]*routeMeta),
+	}
+	server.router.MethodNotAllowedHandler = server.methodNotAllowedHandler(nil)
 	logger.Println("Successfully made buv.Server")
 	if options.ConfigFile != "" {
 		err := server.SaveConfigFile(options)
@@ -184,31 +331,41 @@ func (b *Server) Domain(domain, URLName string) {
 	b.router.Host(domain).Name(URLName)
 }
 
+// NotFoundHandler is the same as SetNotFoundHandler.
 func (b *Server) NotFoundHandler(noHandler HandlerFunction) {
-	b.router.NotFoundHandler = b.handler(noHandler)
+	b.SetNotFoundHandler(noHandler)
 }
 
+// SetNotFoundHandler sets the handler for requests that match no registered handler. The
+// response has the status 404 Not Found unless the handler writes another, and may be
+// rendered from a template by using TemplateHandler.
+func (b *Server) SetNotFoundHandler(noHandler HandlerFunction) {
+	b.logger.Println("Setting the not found handler.")
+	b.router.NotFoundHandler = b.statusHandler(http.StatusNotFound, noHandler)
+}
+
+// SetMethodNotAllowedHandler sets the handler for requests whose path matches a registered
+// handler but whose method does not. The response has the status 405 Method Not Allowed
+// unless the handler writes another, and its Allow header lists the methods that would have
+// matched. Without a handler, a plain text response is written.
+func (b *Server) SetMethodNotAllowedHandler(handler HandlerFunction) {
+	b.logger.Println("Setting the method not allowed handler.")
+	b.router.MethodNotAllowedHandler = b.methodNotAllowedHandler(handler)
+}
+
+// GetUrl builds the URL of the route registered with the URLName from its path variables. It
+// logs any error and returns nil; use BuildURL to receive the error and to add query values.
 func (b *Server) GetUrl(URLName string, pathVars map[string]string) *url.URL {
-	route := b.router.Get(URLName)
-	if route == nil {
-		b.logger.Println("GetUrl: No mux.Route with registered name: " + URLName)
-		return nil
-	}
-	pathVarSlice := make([]string, len(pathVars)*2)
-	index := 0
+	pairs := make([]string, 0, len(pathVars)*2)
 	for key, value := range pathVars {
-		pathVarSlice[index] = key
-		index++
-		pathVarSlice[index] = value
-		index++
+		pairs = append(pairs, key, value)
 	}
-	url, err := route.URL(pathVarSlice...)
+	url, err := b.BuildURL(URLName, pairs...)
 	if err != nil {
 		b.logger.Println("GetUrl: " + err.Error())
 		return nil
-	} else {
-		return url
 	}
+	return url
 }
 
 // AddHandleFunc adds a handler function to the web server.
@@ -223,92 +380,186 @@ func (b *Server) GetUrl(URLName string, pathVars map[string]string) *url.URL {
 //                       values are specific values (A value of "" matches any value).
 // -URLParent       Optional: If specified, the subrouter based on the parent URI/URA is used and therefore this match will only
 //                       be attempted if the parent also matches.
+//
+// AddHandleFunc logs, rather than returns, any error registering the handler. Prefer Route, which
+// returns the error and also exposes host and header matching.
 func (b *Server) AddHandleFunc(schemes []string, path, URLName string, handleFunc HandlerFunction, redirectors []Redirector, methods []string, queries map[string]string, URLParent string) {
-	var querySlice []string = nil
-	if queries != nil {
-		querySlice = make([]string, len(queries)*2)
-		index := 0
-		for key, value := range queries {
-			querySlice[index] = key
-			index++
-			querySlice[index] = value
-			index++
-		}
+	route := b.Route(path).Name(URLName).Schemes(schemes...).Methods(methods...).Guard(redirectors...).Parent(URLParent)
+	for key, value := range queries {
+		route.Queries(key, value)
 	}
-
-	r := b.router
-	if len(URLParent) > 0 {
-		temp := b.router.Get(URLParent)
-		if temp == nil {
-			b.logger.Println("AddHandleFuncSubrouter parent not found: " + URLParent)
-			return
-		} else {
-			b.logger.Println("AddHandleFunc parent found: " + URLParent)
-			r = temp.Subrouter()
-		}
-	} else {
-		b.logger.Println("AddHandleFunc no parent specified")
+	if err := route.Handle(handleFunc); err != nil {
+		b.logger.Println("AddHandleFunc: " + err.Error())
 	}
+}
 
-	if len(querySlice) > 0 {
-		b.logger.Println("AddHandleFunc schemes=" + strings.Join(schemes, ":") + ", URLName=" + URLName + ", path=" + path + ", methods=" + strings.Join(methods, ":") + ", queries=" + strings.Join(querySlice, ":"))
-		r.HandleFunc(path, b.handler(redirectOrHandler(handleFunc, redirectors...))).Schemes(schemes...).Methods(methods...).Name(URLName).Queries(querySlice...)
-	} else {
-		b.logger.Println("AddHandleFunc schemes=" + strings.Join(schemes, ":") + ", URLName=" + URLName + ", path=" + path + ", methods=" + strings.Join(methods, ":") + " (no queries)")
-		r.HandleFunc(path, b.handler(redirectOrHandler(handleFunc, redirectors...))).Schemes(schemes...).Methods(methods...).Name(URLName)
-	}
+// Use adds middleware wrapping every handler registered with the Server, including the not found
+// handler and those registered before Use is called. It is applied outside any Group or route
+// middleware, and must not be called while the Server is serving.
+func (b *Server) Use(middleware ...Middleware) {
+	b.logger.Println("Use: adding " + strconv.Itoa(len(middleware)) + " middleware")
+	b.middleware = append(b.middleware, middleware...)
+}
+
+// SetMaxBodyBytes overrides the ServerOptions' MaxBodyBytes for the route registered with the
+// URLName. A value of 0 removes the limit for the route.
+func (b *Server) SetMaxBodyBytes(URLName string, maxBytes int64) {
+	b.logger.Println("SetMaxBodyBytes URLName=" + URLName + ", maxBytes=" + strconv.FormatInt(maxBytes, 10))
+	b.bodyLimits[URLName] = maxBytes
+}
+
+// ServeHTTP dispatches the request to the handler registered with the Server whose pattern
+// most closely matches the request. It allows a Server to be mounted under another
+// http.Handler, such as a http.ServeMux, without calling Start.
+func (b *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.router.ServeHTTP(w, r)
 }
 
 // Starts up the web service, using the specified domain, template files, port address, css & javascript asset folders,
-// handler map, and default handler for invalid URIs.
+// handler map, and default handler for invalid URIs. The address is a TCP address such as ":8080", a Unix domain socket
+// such as "unix:/run/app.sock", or a socket passed in by systemd such as "systemd:". TLS is served if the ServerOptions
+// specified certificates. If the Server cannot begin serving, a *StartError is returned and the Server is left stopped
+// so that Start may be called again.
 func (b *Server) Start(address string, assetFolderToExtension map[string]string) error {
+	return b.StartBinds([]Bind{{Address: address, TLS: b.tlsConfig != nil}}, assetFolderToExtension)
+}
+
+// StartBinds starts up the web service like Start, but serves on every one of the binds at once with
+// the same handlers. Requests are matched against the schemes of registered handlers using the Scheme
+// of the bind that accepted them, so one Server may serve both HTTP_SCHEME and HTTPS_SCHEME handlers.
+func (b *Server) StartBinds(binds []Bind, assetFolderToExtension map[string]string) error {
 	defer b.logger.Println(trackElapsed(time.Now(), "*Server Startup*"))
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.running {
+		return ErrServerStarted
+	}
 	b.logger.Start()
 	b.logger.Println("Begin *Server Startup*")
 
-	b.logger.Println("Starting up template watcher.")
-	b.templateManager.Start()
-
-	for assetFolder, assetExtension := range assetFolderToExtension {
-		b.logger.Println("Adding asset handler: " + assetFolder + "{asset:[a-z0-9A-Z_]+(" + assetExtension + ")}")
-		b.router.HandleFunc(""+assetFolder+"{asset:[a-z0-9A-Z_]+("+assetExtension+")}", b.assetHandler(assetFolder))
+	bindings := make([]*binding, 0, len(binds))
+	closeAll := func() {
+		for _, bound := range bindings {
+			bound.rawListener.Close()
+		}
 	}
-
-	b.logger.Println("Adding favicon.ico support: /favicon.ico")
-	b.router.HandleFunc("/favicon.ico", b.assetHandler(""))
-
-	http.Handle("/", b.router)
-	b.logger.Println("Finished building handlers.")
-
-	b.logger.Println("Creating listener on address " + address)
-	list, err := net.Listen("tcp", address)
-	b.listener = list
+	for _, bind := range binds {
+		if bind.TLS && b.tlsConfig == nil {
+			closeAll()
+			return &StartError{bind.Address, nil, errors.New("no TLS certificates specified in the ServerOptions")}
+		}
+		b.logger.Println("Creating listener on address " + bind.Address)
+		list, err := b.listen(bind.Address)
+		if err != nil {
+			b.logger.Println("Error: " + err.Error())
+			closeAll()
+			return newStartError(bind.Address, err)
+		}
+		bindings = append(bindings, &binding{bind: bind, rawListener: list})
+	}
+	if b.getOptions().RedirectAddress != "" {
+		b.logger.Println("Creating HTTPS redirect listener on address " + b.getOptions().RedirectAddress)
+		list, err := b.listen(b.getOptions().RedirectAddress)
+		if err != nil {
+			b.logger.Println("Error: " + err.Error())
+			closeAll()
+			return newStartError(b.getOptions().RedirectAddress, err)
+		}
+		bind := Bind{Address: b.getOptions().RedirectAddress, Scheme: HTTP_SCHEME}
+		bindings = append(bindings, &binding{bind: bind, rawListener: list, redirect: true})
+	}
+	err := b.serve(bindings, assetFolderToExtension)
 	if err != nil {
-		b.logger.Fatal("Error: " + err.Error())
+		closeAll()
 	}
+	return err
+}
 
-	b.logger.Println("Creating channel for shutdown notification.")
-	b.servNotifier = make(chan bool)
-	go func(l net.Listener, ch chan<- bool) {
-		b.logger.Println("Begin serving on listener with address: " + l.Addr().String())
-		http.Serve(l, nil)
-		b.logger.Println("Ending Serve. Sending shutdown notification to channel")
-		ch <- true
-	}(b.listener, b.servNotifier)
-	return nil
+// StartListener starts up the web service like Start, but serves on a listener supplied by the
+// caller. The listener is closed when the Server is shut down, but not if it fails to start.
+func (b *Server) StartListener(listener net.Listener, assetFolderToExtension map[string]string) error {
+	defer b.logger.Println(trackElapsed(time.Now(), "*Server Startup*"))
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.running {
+		return ErrServerStarted
+	}
+	b.logger.Start()
+	b.logger.Println("Begin *Server Startup*")
+	b.logger.Println("Using listener on address " + listener.Addr().String())
+	bind := Bind{Address: listener.Addr().String(), TLS: b.tlsConfig != nil}
+	return b.serve([]*binding{{bind: bind, rawListener: listener}}, assetFolderToExtension)
 }
 
-// Gracefully shuts down the Buv web server and terminates connections.
+// Wait blocks until the Server stops serving on all of its listeners and returns the first error
+// serving ended with. It returns nil if serving ended because the Server was shut down.
+func (b *Server) Wait() error {
+	b.mutex.Lock()
+	ch := b.servNotifier
+	b.mutex.Unlock()
+	if ch == nil {
+		return ErrServerNotStarted
+	}
+	<-ch
+	return b.serveErr
+}
+
+// Gracefully shuts down the Buv web server, waiting for all in-flight requests to finish
+// before terminating connections.
 func (b *Server) Shutdown() {
+	b.ShutdownContext(context.Background())
+}
+
+// ShutdownContext gracefully shuts down the Buv web server. It stops accepting new
+// connections and waits for in-flight requests to finish until the context is done, at
+// which point the remaining connections are forcibly closed. Closing a connection does not
+// stop its handler, so the Server then waits for the cut off handlers to return. Only then
+// are the template watcher and logger stopped. It returns the number of requests that were
+// still in flight when they were forcibly closed, and the context's error if the deadline
+// was hit.
+func (b *Server) ShutdownContext(ctx context.Context) (forceClosed int, e error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.running {
+		return 0, ErrServerNotStarted
+	}
 	defer b.logger.Println(trackElapsed(time.Now(), "*Server Shutdown*"))
 	b.logger.Println("Begin *Server Shutdown*")
-	b.logger.Println("Closing the listener.")
-	b.listener.Close()
-	b.logger.Println("Stopping the template watcher.")
-	b.templateManager.Stop()
+	b.logger.Println("Closing the listeners and draining in-flight requests.")
+	errs := make(chan error, len(b.bindings))
+	for _, bound := range b.bindings {
+		go func(srv *http.Server) {
+			errs <- srv.Shutdown(ctx)
+		}(bound.server)
+	}
+	var err error
+	for range b.bindings {
+		if shutdownErr := <-errs; shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	if err != nil {
+		forceClosed = int(atomic.LoadInt64(&b.inFlight))
+		b.logger.Println("Error draining requests: " + err.Error())
+		b.logger.Println("Force closing connections with " + strconv.Itoa(forceClosed) + " requests in flight.")
+		for _, bound := range b.bindings {
+			bound.server.Close()
+		}
+		b.logger.Println("Waiting for the handlers of forcibly closed requests to return.")
+		b.waitForHandlers()
+	}
 	b.logger.Println("Waiting for shutdown notification.")
 	<-b.servNotifier
+	b.running = false
+	b.bindings = nil
+	b.logger.Println("Stopping the template watchers.")
+	b.stopTemplateWatchers()
+	if b.certReloader != nil {
+		b.logger.Println("Stopping the TLS certificate reloader.")
+		b.certReloader.Stop()
+	}
 	b.logger.Stop()
+	return forceClosed, err
 }
 
 func (b *Server) GetStringSessionValue(request *http.Request, sessionName string, key string) string {
@@ -457,8 +708,5 @@ func (b *Server) Println(logString string) {
 }
 
 func (b *Server) RenderTemplate(w http.ResponseWriter, tmpl string, p interface{}) {
-	err := b.templateManager.ExecuteTemplate(w, tmpl, p)
-	if err != nil {
-		b.logger.Println("buv.Server RenderTemplate error: " + err.Error())
-	}
+	b.executeTemplate(nil, w, tmpl, p)
 }
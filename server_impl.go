@@ -19,11 +19,22 @@ package buv
 */
 
 import (
+	"bitbucket.org/cjslep/goTem"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,8 +55,16 @@ func redirectOrHandler(b HandlerFunction, redirs ...Redirector) HandlerFunction
 	}
 }
 
+// chain wraps the handler in the middleware, the first of which is outermost.
+func chain(handleFunc HandlerFunction, middleware []Middleware) HandlerFunction {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handleFunc = middleware[i](handleFunc)
+	}
+	return handleFunc
+}
+
 func (b *Server) getSession(request *http.Request, sessionName string) *sessions.Session {
-	sess, err := b.cookieStore.Get(request, sessionName)
+	sess, err := b.sessionStore().Get(request, sessionName)
 	if err != nil {
 		b.logger.Println(err.Error())
 		return nil
@@ -61,16 +80,430 @@ func (b *Server) saveSession(r *http.Request, w http.ResponseWriter, session *se
 }
 
 func (b *Server) handler(fn HandlerFunction) http.HandlerFunc {
+	return b.templateHandler(fn, nil)
+}
+
+// templateHandler serves the handler function, rendering templates from the virtual host's
+// templates or from the Server's templates if it is nil.
+func (b *Server) templateHandler(fn HandlerFunction, templates *hostTemplates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw, ok := w.(*statusWriter)
+		if !ok {
+			sw = &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		}
+		temp := HandlerData{w: sw, r: r, server: b, templates: templates, sw: sw}
+		if limit := b.bodyLimit(r); limit > 0 {
+			if r.ContentLength > limit {
+				b.requestTooLarge(&temp)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		defer temp.removeUploads()
+		chain(fn, b.middleware)(&temp)
+		if !sw.wroteHeader && sw.status != http.StatusOK {
+			sw.WriteHeader(sw.status)
+		}
+	}
+}
+
+// statusHandler serves the handler function with the status code as the response's default.
+func (b *Server) statusHandler(code int, fn HandlerFunction) http.HandlerFunc {
+	handler := b.handler(fn)
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(&statusWriter{ResponseWriter: w, status: code}, r)
+	}
+}
+
+// methodNotAllowedHandler answers requests with a 405 Method Not Allowed status and an Allow
+// header, using the handler function to write the response if it is not nil.
+func (b *Server) methodNotAllowedHandler(fn HandlerFunction) http.HandlerFunc {
+	var handler http.HandlerFunc
+	if fn != nil {
+		handler = b.statusHandler(http.StatusMethodNotAllowed, fn)
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		temp := HandlerData{w, r, b}
-		fn(&temp)
+		w.Header().Set("Allow", strings.Join(b.allowedMethods(r), ", "))
+		if handler != nil {
+			handler(w, r)
+		} else {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// allowedMethods returns the HTTP methods with which the request would have matched a route.
+func (b *Server) allowedMethods(r *http.Request) []string {
+	var allowed []string
+	for _, method := range allHTTPMethods {
+		req := r.Clone(r.Context())
+		req.Method = method
+		var match mux.RouteMatch
+		if b.router.Match(req, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// statusWriter holds the status code of a response until its headers are sent, so handlers may
+// set the status and headers at any point before writing the body, and tracks whether they
+// have been sent. Once buv has answered the request itself, such as with 413 Request Entity
+// Too Large, it drops the handler's writes and header changes, failing writes with the error the
+// request was answered for.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	answered    error
+	dropped     http.Header
+}
+
+func (s *statusWriter) Header() http.Header {
+	if s.answered != nil {
+		if s.dropped == nil {
+			s.dropped = make(http.Header)
+		}
+		return s.dropped
+	}
+	return s.ResponseWriter.Header()
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.wroteHeader {
+		return
+	}
+	s.wroteHeader = true
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.answered != nil {
+		return 0, s.answered
+	}
+	if !s.wroteHeader {
+		s.WriteHeader(s.status)
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Unwrap allows a http.ResponseController to reach the underlying http.ResponseWriter.
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// discardWriter is a http.ResponseWriter that discards the response, for HandlerData that has
+// no response to write to.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	if d.header == nil {
+		d.header = make(http.Header)
+	}
+	return d.header
+}
+
+func (d *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (d *discardWriter) WriteHeader(code int) {}
+
+// bodyLimit returns the maximum number of body bytes for the route matching the request.
+func (b *Server) bodyLimit(r *http.Request) int64 {
+	if route := mux.CurrentRoute(r); route != nil {
+		if limit, ok := b.bodyLimits[route.GetName()]; ok {
+			return limit
+		}
+	}
+	return b.getOptions().MaxBodyBytes
+}
+
+// requestTooLarge answers a request whose body exceeds its limit.
+func (b *Server) requestTooLarge(data *HandlerData) {
+	if data.tooLarge {
+		return
+	}
+	data.tooLarge = true
+	b.logger.Println("Request body too large: " + data.String())
+	http.Error(data.w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	data.sw.answered = ErrRequestTooLarge
+}
+
+// trackRequests counts the requests being served by next so that a shutdown can report
+// how many were cut off.
+func (b *Server) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&b.inFlight, 1)
+		defer atomic.AddInt64(&b.inFlight, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// waitForHandlers blocks until no handler tracked by trackRequests is running.
+func (b *Server) waitForHandlers() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&b.inFlight) > 0 {
+		<-ticker.C
+	}
+}
+
+// serve begins serving on the listeners opened for the bindings. The caller must hold the
+// Server's mutex.
+func (b *Server) serve(bindings []*binding, assetFolderToExtension map[string]string) error {
+	address := ""
+	if len(bindings) > 0 {
+		address = bindings[0].bind.Address
+	}
+	err := b.RegisterConfigRoutes()
+	if err != nil {
+		return &StartError{address, ErrConfigRoutes, err}
+	}
+	b.logger.Println("Starting up template watcher.")
+	err = b.startTemplateWatcher()
+	if err != nil {
+		b.logger.Println("Error: " + err.Error())
+		return &StartError{address, ErrTemplateWatcher, err}
+	}
+
+	for assetFolder, assetExtension := range assetFolderToExtension {
+		b.addAssetHandler(assetFolder+"{asset:[a-z0-9A-Z_]+("+assetExtension+")}", assetFolder)
+	}
+
+	b.addAssetHandler("/favicon.ico", "")
+
+	b.logger.Println("Finished building handlers.")
+
+	if b.certReloader != nil {
+		b.logger.Println("Starting up TLS certificate reloader.")
+		b.certReloader.Start()
+	}
+
+	b.logger.Println("Creating channel for shutdown notification.")
+	b.servNotifier = make(chan struct{})
+	b.serveErr = nil
+	b.bindings = bindings
+	b.running = true
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	for _, bound := range bindings {
+		bound.listener = bound.rawListener
+		if bound.bind.TLS {
+			b.logger.Println("Serving TLS on address " + bound.bind.Address)
+			bound.listener = tls.NewListener(bound.rawListener, b.tlsConfig)
+		}
+		if bound.redirect {
+			b.logger.Println("Redirecting to HTTPS on address " + bound.bind.Address)
+			bound.server = b.newHTTPServer(http.HandlerFunc(b.redirectToHTTPS))
+		} else {
+			bound.server = b.newHTTPServer(b.schemeHandler(bound.bind.scheme()))
+		}
+		wg.Add(1)
+		go func(srv *http.Server, l net.Listener) {
+			defer wg.Done()
+			b.logger.Println("Begin serving on listener with address: " + l.Addr().String())
+			err := srv.Serve(l)
+			if err == http.ErrServerClosed {
+				err = nil
+			} else if err != nil {
+				b.logger.Println("Serve error: " + err.Error())
+				errOnce.Do(func() { b.serveErr = err })
+			}
+			b.logger.Println("Ending Serve on listener with address: " + l.Addr().String())
+		}(bound.server, bound.listener)
+	}
+	go func(ch chan<- struct{}) {
+		wg.Wait()
+		b.logger.Println("All listeners stopped. Sending shutdown notification to channel")
+		close(ch)
+	}(b.servNotifier)
+	notifyParentReady()
+	return nil
+}
+
+// newHTTPServer creates a http.Server for the handler, configured by the ServerOptions.
+func (b *Server) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           b.trackRequests(handler),
+		ReadTimeout:       time.Duration(b.getOptions().ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(b.getOptions().ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(b.getOptions().WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(b.getOptions().IdleTimeout) * time.Second,
+		MaxHeaderBytes:    b.getOptions().MaxHeaderBytes,
+	}
+}
+
+// schemeHandler tags requests with the scheme of the listener that accepted them, which the
+// net/http server otherwise leaves empty, before routing them.
+func (b *Server) schemeHandler(scheme string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = scheme
+		if scheme == HTTPS_SCHEME {
+			if hsts := b.hstsHeader(); hsts != "" {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+		}
+		b.ServeHTTP(w, r)
+	})
+}
+
+// hstsHeader returns the Strict-Transport-Security header value configured by the
+// ServerOptions, or "" if it is not to be sent.
+func (b *Server) hstsHeader() string {
+	if b.getOptions().HSTSMaxAge <= 0 {
+		return ""
+	}
+	hsts := "max-age=" + strconv.Itoa(b.getOptions().HSTSMaxAge)
+	if b.getOptions().HSTSIncludeSubdomains {
+		hsts += "; includeSubDomains"
+	}
+	if b.getOptions().HSTSPreload {
+		hsts += "; preload"
+	}
+	return hsts
+}
+
+// redirectToHTTPS redirects the request to the same host, path and query over HTTPS, so links
+// built by GetUrl lead to the same named route once redirected. A request without a Host header
+// is redirected to the local address it was received on.
+func (b *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := redirectHost(r)
+	if host == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if port := b.getOptions().RedirectHTTPSPort; port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	target := url.URL{Scheme: HTTPS_SCHEME, Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	code := http.StatusMovedPermanently
+	if r.Method != HTTP_METHOD_GET && r.Method != HTTP_METHOD_HEAD {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, target.String(), code)
+}
+
+// redirectHost returns the host of the request without any port or IPv6 brackets, falling back
+// to the local address the request was received on if it has no Host header.
+func redirectHost(r *http.Request) string {
+	host := r.Host
+	if host == "" {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			host = addr.String()
+		}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// parentRouter returns the subrouter for the children of the route registered with the
+// URLName, creating it the first time a child route is registered. The subrouter belongs to a
+// route matching the parent's path as a prefix, registered after the parent so the parent's own
+// path still reaches the parent's handler.
+func (b *Server) parentRouter(URLName string) (*mux.Router, error) {
+	if router, ok := b.parentRouters[URLName]; ok {
+		return router, nil
+	}
+	meta := b.routeMeta[b.router.Get(URLName)]
+	if meta == nil {
+		return nil, errors.New("parent " + URLName + " was not registered with Route")
+	}
+	prefix, err := meta.builder.build(meta.router, true)
+	if err != nil {
+		return nil, err
+	}
+	router := prefix.Subrouter()
+	b.parentRouters[URLName] = router
+	return router, nil
+}
+
+// getOptions returns the ServerOptions currently in effect, which may be replaced by Reload.
+func (b *Server) getOptions() *ServerOptions {
+	b.optionsMutex.RLock()
+	defer b.optionsMutex.RUnlock()
+	return b.options
+}
+
+// templates returns the template watcher currently in use, which may be replaced by Reload.
+func (b *Server) templates() *goTem.HTMLTemplateWatcher {
+	b.optionsMutex.RLock()
+	defer b.optionsMutex.RUnlock()
+	return b.templateManager
+}
+
+// sessionStore returns the session store currently in use, which may be replaced by Reload.
+func (b *Server) sessionStore() *sessions.CookieStore {
+	b.optionsMutex.RLock()
+	defer b.optionsMutex.RUnlock()
+	return b.cookieStore
+}
+
+// watcher returns the template watcher currently in use for the virtual host's templates, or
+// the Server's if it is nil. Either may be replaced by Reload.
+func (b *Server) watcher(templates *hostTemplates) *goTem.HTMLTemplateWatcher {
+	b.optionsMutex.RLock()
+	defer b.optionsMutex.RUnlock()
+	if templates == nil {
+		return b.templateManager
+	}
+	return templates.watcher
+}
+
+// startTemplateWatcher starts the template watcher, turning a panic while doing so into an
+// error so that a failed Start does not take down the process.
+func (b *Server) startTemplateWatcher() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	b.templates().Start()
+	for _, templates := range b.hostTemplates {
+		b.watcher(templates).Start()
+	}
+	return nil
+}
+
+// stopTemplateWatchers stops the Server's template watcher and those of its virtual hosts.
+func (b *Server) stopTemplateWatchers() {
+	b.templates().Stop()
+	for _, templates := range b.hostTemplates {
+		b.watcher(templates).Stop()
+	}
+}
+
+// executeTemplate renders the template from the virtual host's templates, or from the Server's
+// templates if it is nil.
+func (b *Server) executeTemplate(templates *hostTemplates, w http.ResponseWriter, tmpl string, p interface{}) {
+	err := b.watcher(templates).ExecuteTemplate(w, tmpl, p)
+	if err != nil {
+		b.logger.Println("buv.Server RenderTemplate error: " + err.Error())
+	}
+}
+
+// addAssetHandler serves the assets in assetFolder matching the pattern, doing nothing if
+// the pattern was already added by a previous Start.
+func (b *Server) addAssetHandler(pattern, assetFolder string) {
+	if b.assetPatterns[pattern] {
+		return
 	}
+	b.logger.Println("Adding asset handler: " + pattern)
+	b.router.HandleFunc(pattern, b.assetHandler(".", assetFolder))
+	b.assetPatterns[pattern] = true
 }
 
-func (b *Server) assetHandler(assetFolder string) http.HandlerFunc {
+// assetHandler serves the requested asset from beneath the root directory.
+func (b *Server) assetHandler(root, assetFolder string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		file, err := os.Open("." + r.URL.Path)
+		file, err := os.Open(filepath.Join(root, filepath.FromSlash(path.Clean("/"+r.URL.Path))))
 		defer file.Close()
 		if err != nil {
 			http.NotFound(w, r)
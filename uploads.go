@@ -0,0 +1,317 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MAX_FORM_VALUE_BYTES limits the total size of the non-file values of a multipart form.
+	MAX_FORM_VALUE_BYTES = 10 << 20
+
+	// sniffLength is the number of bytes http.DetectContentType considers.
+	sniffLength = 512
+)
+
+// UploadOptions limits the files that may be uploaded to a route.
+type UploadOptions struct {
+	// MaxFileBytes is the maximum size of each uploaded file. A value of 0 uses the
+	// ServerOptions' MaxUploadBytes.
+	MaxFileBytes int64
+
+	// AllowedTypes are the media types uploaded files may have, such as "image/png", or
+	// "image/*" for any image. The type is sniffed from the file's content rather than trusted
+	// from the client. An empty list allows any type.
+	AllowedTypes []string
+}
+
+// Upload is a file uploaded with a multipart form. Its content is streamed to a temporary file
+// in the ServerOptions' UploadDirectory, which is removed once the handler returns unless it
+// has been moved with SaveTo.
+type Upload struct {
+	// FieldName is the name of the form field the file was uploaded with.
+	FieldName string
+
+	// FileName is the base name of the file given by the client, with any directories removed.
+	// It must not be trusted as a path.
+	FileName string
+
+	// ContentType is the media type sniffed from the file's content.
+	ContentType string
+
+	// Size is the size of the file in bytes.
+	Size int64
+
+	path  string
+	saved bool
+}
+
+// Open opens the uploaded file for reading. The caller must close it.
+func (u *Upload) Open() (*os.File, error) {
+	return os.Open(u.path)
+}
+
+// Path returns the path of the temporary file holding the upload.
+func (u *Upload) Path() string {
+	return u.path
+}
+
+// SaveTo moves the uploaded file to the destination path, so it is kept once the handler
+// returns.
+func (u *Upload) SaveTo(dst string) error {
+	if err := os.Rename(u.path, dst); err == nil {
+		u.path = dst
+		u.saved = true
+		return nil
+	}
+	// Renaming fails across file systems, so copy instead.
+	src, err := os.Open(u.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, src); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	os.Remove(u.path)
+	u.path = dst
+	u.saved = true
+	return nil
+}
+
+// uploadSet holds the uploads of a request's multipart form.
+type uploadSet struct {
+	files  map[string][]*Upload
+	errors map[string]error
+	err    error
+}
+
+// FormFile returns the first file uploaded with the form field. It returns ErrNoUpload if none
+// was, ErrUploadTooLarge or ErrUploadType if the file was rejected, and ErrRequestTooLarge if
+// the request body exceeds its route's size limit, in which case the request has been answered
+// with 413 Request Entity Too Large.
+func (h *HandlerData) FormFile(field string) (*Upload, error) {
+	files, err := h.FormFiles(field)
+	if err != nil {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// FormFiles returns every file uploaded with the form field, or the errors of FormFile. If any
+// of the field's files was rejected its error is returned and none of them are.
+func (h *HandlerData) FormFiles(field string) ([]*Upload, error) {
+	uploads := h.parseUploads()
+	if uploads.err != nil {
+		return nil, h.answerForm(uploads.err)
+	} else if err, ok := uploads.errors[field]; ok {
+		return nil, err
+	} else if len(uploads.files[field]) == 0 {
+		return nil, ErrNoUpload
+	}
+	return uploads.files[field], nil
+}
+
+// parseUploads streams the request's multipart form the first time it is called, saving its
+// files to temporary files and its other values to the request's PostForm and Form. The values
+// read before any error are still saved.
+func (h *HandlerData) parseUploads() *uploadSet {
+	if h.uploads != nil {
+		return h.uploads
+	}
+	h.uploads = &uploadSet{files: make(map[string][]*Upload), errors: make(map[string]error)}
+	if h.matching {
+		h.uploads.err = h.matchingBody()
+		return h.uploads
+	}
+	reader, err := h.r.MultipartReader()
+	if err == http.ErrNotMultipart {
+		h.uploads.err = ErrNoUpload
+		return h.uploads
+	} else if err != nil {
+		h.uploads.err = h.formError(err)
+		return h.uploads
+	}
+	form := make(url.Values)
+	h.uploads.err = h.readMultipart(reader, form)
+	h.setForm(form)
+	return h.uploads
+}
+
+// readMultipart reads the parts of the multipart form, adding its values to the form and its
+// files to the request's uploads.
+func (h *HandlerData) readMultipart(reader *multipart.Reader, form url.Values) error {
+	options := h.server.uploadOptionsFor(h.r)
+	valueBytes := int64(MAX_FORM_VALUE_BYTES)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return h.formError(err)
+		}
+		field := part.FormName()
+		if field == "" {
+			continue
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, valueBytes+1))
+			if err != nil {
+				return h.formError(err)
+			}
+			valueBytes -= int64(len(value))
+			if valueBytes < 0 {
+				return h.formError(errors.New("values too large"))
+			}
+			form.Add(field, string(value))
+			continue
+		}
+		upload, err := h.server.saveUpload(part, options)
+		if err == ErrUploadTooLarge || err == ErrUploadType {
+			h.server.Println("Rejected upload " + field + ": " + err.Error() + ": " + h.String())
+			h.uploads.errors[field] = err
+			continue
+		} else if err != nil {
+			var pathErr *os.PathError
+			if errors.As(err, &pathErr) {
+				h.server.Println("Saving upload " + field + ": " + err.Error() + ": " + h.String())
+				return err
+			}
+			return h.formError(err)
+		}
+		h.uploads.files[field] = append(h.uploads.files[field], upload)
+	}
+}
+
+// removeUploads removes the temporary files of the request's uploads that were not saved.
+func (h *HandlerData) removeUploads() {
+	if h.uploads == nil {
+		return
+	}
+	for _, files := range h.uploads.files {
+		for _, upload := range files {
+			if upload.saved {
+				continue
+			}
+			if err := os.Remove(upload.path); err != nil && !os.IsNotExist(err) {
+				h.server.Println("Removing upload: " + err.Error())
+			}
+		}
+	}
+}
+
+// SetUploadOptions sets the UploadOptions of the route registered with the URLName.
+func (b *Server) SetUploadOptions(URLName string, options UploadOptions) {
+	b.logger.Println("SetUploadOptions URLName=" + URLName + ", maxFileBytes=" + strconv.FormatInt(options.MaxFileBytes, 10) + ", allowedTypes=" + strings.Join(options.AllowedTypes, ","))
+	b.uploadOptions[URLName] = options
+}
+
+// uploadOptionsFor returns the UploadOptions of the route matching the request, with the
+// ServerOptions' MaxUploadBytes if it sets no size of its own.
+func (b *Server) uploadOptionsFor(r *http.Request) UploadOptions {
+	var options UploadOptions
+	if route := mux.CurrentRoute(r); route != nil {
+		options = b.uploadOptions[route.GetName()]
+	}
+	if options.MaxFileBytes == 0 {
+		options.MaxFileBytes = b.getOptions().MaxUploadBytes
+	}
+	return options
+}
+
+// saveUpload streams the uploaded file to a temporary file, checking its size and sniffed type
+// against the options.
+func (b *Server) saveUpload(part *multipart.Part, options UploadOptions) (*Upload, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	if !allowedUploadType(contentType, options.AllowedTypes) {
+		return nil, ErrUploadType
+	}
+	file, err := os.CreateTemp(b.getOptions().UploadDirectory, "buv-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader = io.MultiReader(bytes.NewReader(head), part)
+	if options.MaxFileBytes > 0 {
+		src = io.LimitReader(src, options.MaxFileBytes+1)
+	}
+	size, err := io.Copy(file, src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && options.MaxFileBytes > 0 && size > options.MaxFileBytes {
+		err = ErrUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &Upload{
+		FieldName:   part.FormName(),
+		FileName:    path.Base(strings.ReplaceAll(part.FileName(), "\\", "/")),
+		ContentType: contentType,
+		Size:        size,
+		path:        file.Name(),
+	}, nil
+}
+
+// allowedUploadType returns whether the sniffed content type matches one of the allowed media
+// types, or whether any type is allowed.
+func allowedUploadType(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if a == mediaType || (strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+)
+
+// BuildURL builds the URL of the route registered with the URLName. The pairs are alternating
+// variable names and values: those naming a variable of the route's path, host or queries fill
+// it in, and any others are added to the URL's query string. It returns an error naming the
+// route if it is not registered, or if a variable is missing or does not match its pattern.
+func (b *Server) BuildURL(URLName string, pairs ...string) (*url.URL, error) {
+	route := b.router.Get(URLName)
+	if route == nil {
+		return nil, errors.New("buv: no route registered with name " + URLName)
+	}
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("buv: building URL for route " + URLName + ": variables must be name and value pairs")
+	}
+	names, err := route.GetVarNames()
+	if err != nil {
+		return nil, errors.New("buv: building URL for route " + URLName + ": " + err.Error())
+	}
+	isVar := make(map[string]bool, len(names))
+	for _, name := range names {
+		isVar[name] = true
+	}
+	var routePairs []string
+	extra := url.Values{}
+	for i := 0; i < len(pairs); i += 2 {
+		if isVar[pairs[i]] {
+			routePairs = append(routePairs, pairs[i], pairs[i+1])
+		} else {
+			extra.Add(pairs[i], pairs[i+1])
+		}
+	}
+	u, err := route.URL(routePairs...)
+	if err != nil {
+		return nil, errors.New("buv: building URL for route " + URLName + ": " + err.Error())
+	}
+	if len(extra) > 0 {
+		query := u.Query()
+		for key, values := range extra {
+			query[key] = append(query[key], values...)
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u, nil
+}
+
+// BuildAbsoluteURL builds the URL of the route like BuildURL, using the scheme and host for the
+// URL unless the route was registered with a host of its own.
+func (b *Server) BuildAbsoluteURL(URLName, scheme, host string, pairs ...string) (*url.URL, error) {
+	u, err := b.BuildURL(URLName, pairs...)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		u.Scheme = scheme
+		u.Host = host
+	}
+	return u, nil
+}
+
+// TemplateFuncs returns the template functions for building the URLs of routes in templates the
+// caller parses itself, so links need not be hardcoded:
+//
+//	<a href="{{url "user" "id" .ID}}">Profile</a>
+//	<a href="{{absurl "user" "https" "example.com" "id" .ID}}">Share</a>
+//
+// Variable values may be of any type and are formatted with fmt.Sprint. The functions are added
+// to a template with template.Template's Funcs before it is parsed. The template watcher parses
+// the templates the Server and its virtual hosts load from their TemplatePath without them, so
+// those templates are rendered with HandlerData's RenderURLTemplate instead, which gives them
+// the same functions as methods of a TemplateData.
+func (b *Server) TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"url": func(URLName string, pairs ...interface{}) (string, error) {
+			u, err := b.BuildURL(URLName, formatURLPairs(pairs)...)
+			if err != nil {
+				return "", err
+			}
+			return u.String(), nil
+		},
+		"absurl": func(URLName, scheme, host string, pairs ...interface{}) (string, error) {
+			u, err := b.BuildAbsoluteURL(URLName, scheme, host, formatURLPairs(pairs)...)
+			if err != nil {
+				return "", err
+			}
+			return u.String(), nil
+		},
+	}
+}
+
+// TemplateData is the data RenderURLTemplate renders a template with. It carries the data given
+// to RenderURLTemplate alongside methods building the URLs of routes:
+//
+//	<a href="{{.URL "user" "id" .Data.ID}}">Profile</a>
+//	<a href="{{.AbsURL "user" "id" .Data.ID}}">Share</a>
+type TemplateData struct {
+	// Data is the data given to RenderURLTemplate.
+	Data interface{}
+
+	handler *HandlerData
+}
+
+// URL builds the URL of the route registered with the URLName, as described by BuildURL.
+// Variable values may be of any type and are formatted with fmt.Sprint.
+func (t *TemplateData) URL(URLName string, pairs ...interface{}) (string, error) {
+	u, err := t.handler.BuildURL(URLName, formatURLPairs(pairs)...)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// AbsURL builds the absolute URL of the route registered with the URLName, using the scheme and
+// host of the request as described by HandlerData's BuildAbsoluteURL.
+func (t *TemplateData) AbsURL(URLName string, pairs ...interface{}) (string, error) {
+	u, err := t.handler.BuildAbsoluteURL(URLName, formatURLPairs(pairs)...)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// RenderURLTemplate renders the registered template like RenderTemplate, with a TemplateData
+// wrapping the template data so the template can build the URLs of routes.
+func (h *HandlerData) RenderURLTemplate(templateName string, templateData interface{}) {
+	h.RenderTemplate(templateName, &TemplateData{templateData, h})
+}
+
+// formatURLPairs formats the names and values of URL variables given to a template.
+func formatURLPairs(pairs []interface{}) []string {
+	formatted := make([]string, len(pairs))
+	for i, pair := range pairs {
+		formatted[i] = fmt.Sprint(pair)
+	}
+	return formatted
+}
@@ -0,0 +1,89 @@
+package buv
+
+/*
+	This file is a part of Buv
+	Copyright (C) 2014  Cory J. Slep
+
+    Buv is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Lesser General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Buv is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Lesser General Public License for more details.
+
+    You should have received a copy of the GNU Lesser General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bitbucket.org/cjslep/goTem"
+	"errors"
+)
+
+// VirtualHostOptions describes a virtual host served by a Server alongside its other routes.
+type VirtualHostOptions struct {
+	// Host is the host pattern of the virtual host, such as "example.com" or
+	// "{subdomain}.example.com". Host variables are available to handlers through PathVar and
+	// must be given to GetUrl and BuildURL to build the URLs of the virtual host's routes.
+	Host string
+
+	// TemplatePath is the optional path to the directory containing the virtual host's template
+	// files. Handlers of the virtual host's routes render templates from it instead of the
+	// Server's TemplatePath.
+	TemplatePath string
+
+	// TemplateExtension is the extension used by the virtual host's template files.
+	TemplateExtension string
+
+	// AssetRoot is the directory the virtual host's assets are served from. A value of "" serves
+	// them relative to the working directory, like the Server's assets.
+	AssetRoot string
+
+	// Assets maps the virtual host's asset folders to the extensions of the assets to serve from
+	// them, like the asset folders given to Start.
+	Assets map[string]string
+}
+
+// hostTemplates are the templates of a virtual host, whose watcher may be replaced by Reload.
+type hostTemplates struct {
+	path      string
+	extension string
+	watcher   *goTem.HTMLTemplateWatcher
+}
+
+// VirtualHost creates a Group whose routes only match requests for the virtual host's Host,
+// render templates from its TemplatePath, and are guarded by the redirectors. Its assets are
+// served immediately. It returns an error if the Host is empty or the templates cannot be loaded.
+func (b *Server) VirtualHost(options VirtualHostOptions, redirectors ...Redirector) (*Group, error) {
+	if options.Host == "" {
+		return nil, errors.New("buv: virtual host requires a Host")
+	}
+	b.logger.Println("Adding virtual host: " + options.Host)
+	group := b.Group("", redirectors...).Host(options.Host)
+	if options.TemplatePath != "" {
+		watcher, err := goTem.NewHTMLTemplateWatcher(options.TemplatePath, options.TemplateExtension, b.logger)
+		if err != nil {
+			return nil, err
+		}
+		group.templates = &hostTemplates{options.TemplatePath, options.TemplateExtension, watcher}
+		b.mutex.Lock()
+		b.hostTemplates = append(b.hostTemplates, group.templates)
+		if b.running {
+			watcher.Start()
+		}
+		b.mutex.Unlock()
+	}
+	root := options.AssetRoot
+	if root == "" {
+		root = "."
+	}
+	for assetFolder, assetExtension := range options.Assets {
+		pattern := assetFolder + "{asset:[a-z0-9A-Z_]+(" + assetExtension + ")}"
+		b.logger.Println("Adding asset handler: " + options.Host + pattern)
+		group.muxRouter().HandleFunc(pattern, b.assetHandler(root, assetFolder))
+	}
+	return group, nil
+}